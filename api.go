@@ -1,44 +1,339 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha3"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/augustoroman/hashex/task"
 )
 
-// time_Sleep is called indirectly for a quick-and-dirty testing solution.
+// time_NewTimer is called indirectly for a quick-and-dirty testing solution.
 // This works well when time.* usage is infrequent and testing requirements
 // are minimal, which fits this situation. More complicated time stuff should
 // use a fake clock API.
-var time_Sleep = time.Sleep
+var time_NewTimer = time.NewTimer
+var time_Now = time.Now
+
+// DefaultAlgorithm is the hash algorithm used when the client doesn't ask for
+// a specific one.
+const DefaultAlgorithm = "sha512"
+
+// hashAlgorithms are the supported hash algorithms, by the name that clients
+// use to select them.
+var hashAlgorithms = map[string]func() hash.Hash{
+	// sha512 for passwords? that's atypical.
+	"sha512": sha512.New,
+	"sha256": sha256.New,
+	// For those who prefer something more modern than SHA-2.
+	"sha3-256": func() hash.Hash { return sha3.New256() },
+	"sha3-512": func() hash.Hash { return sha3.New512() },
+	// NOTE(aroman) blake2b-512 is deliberately not supported (yet). It needs
+	// golang.org/x/crypto/blake2b, and this tree has no go.mod or vendored
+	// dependencies to pull it in with. Once it does, add it here along with a
+	// known-answer test in TestHashApi.
+	// sha1 and md5 are broken, but plenty of legacy systems still want them.
+	"sha1": sha1.New,
+	"md5":  md5.New,
+	// Only worthwhile for large (multi-MB) inputs.
+	"sha512-tree": func() hash.Hash { return newTreeHash(sha512.New) },
+	// Not secure at all, but fast. Handy for quick dedup checks alongside a
+	// secure hash.
+	"crc32": func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// hmacAlgorithms are the supported HMACs, which are keyed with the server's
+// HashApi.HMACKey. They're for authenticating messages rather than hashing
+// passwords: only whoever has the key can compute (or verify) them.
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha512": sha512.New,
+	"hmac-sha256": sha256.New,
+}
+
+// ErrNoHMACKey is the error for hashing with an HMAC algorithm without a key.
+var ErrNoHMACKey = errors.New("no HMAC key is configured")
+
+// newHasher returns the named hash algorithm, keyed with the key if it's an
+// HMAC. The name must be valid, see checkAlgorithms.
+func newHasher(name string, key []byte) (hash.Hash, error) {
+	if newHash := hmacAlgorithms[name]; newHash != nil {
+		if len(key) == 0 {
+			return nil, ErrNoHMACKey
+		}
+		return hmac.New(newHash, key), nil
+	}
+	return hashAlgorithms[name](), nil
+}
+
+// usesHMAC returns whether any of the comma-separated algorithms is an HMAC.
+func usesHMAC(algo string) bool {
+	for _, name := range strings.Split(algo, ",") {
+		if hmacAlgorithms[name] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hashEncodings are the supported ways to encode the digests as strings.
+var hashEncodings = map[string]func([]byte) string{
+	"base64": base64.StdEncoding.EncodeToString,
+	"hex":    hex.EncodeToString,
+}
+
+// DefaultEncoding is used for tasks that don't specify an encoding.
+const DefaultEncoding = "base64"
+
+// checkAlgorithms returns an error unless algo is a supported algorithm name
+// or a comma-separated list of them.
+func checkAlgorithms(algo string) error {
+	for _, name := range strings.Split(algo, ",") {
+		if hashAlgorithms[name] == nil && hmacAlgorithms[name] == nil {
+			return fmt.Errorf("unknown hash algorithm %q", name)
+		}
+	}
+	return nil
+}
 
 // HashTask is the task.Interface implementation for the HashApi tasks. The
-// result is a string that is the sha512 hash of the string, base64-encoded.
-type HashTask string
+// result is a string that is the hash of the password, base64-encoded (or
+// hex-encoded, see Encoding).
+//
+// If several algorithms are requested, the result is instead a map of
+// algorithm name to the encoded hash. All of the hashes are computed
+// in a single pass over the input.
+//
+// If there's a salt, the result is a SaltedHash instead, so that whoever gets
+// the hash also knows what salt to verify it with.
+type HashTask struct {
+	Password string
+	// Salt, if set, is prepended to the password before hashing, see
+	// saltPrefix.
+	Salt string
+	// Algo is the name of the hash algorithm to use, or a comma-separated
+	// list of names. If empty, DefaultAlgorithm is used.
+	Algo string
+	// Delay is an artificial delay before computing the hash. Zero means no
+	// delay.
+	Delay time.Duration
+	// Encoding is how the hash is encoded in the result, "base64" or "hex". If
+	// empty, DefaultEncoding is used.
+	Encoding string
+	// Iterations is how many times the hash is computed: each iteration
+	// hashes the raw digest of the previous one, which stretches the work
+	// needed to brute-force the input (like PBKDF2, but not compatible with
+	// it). The salt is only hashed in the first iteration. Zero means once.
+	Iterations int
+
+	// key is the secret for the hmac-* algorithms, see HashApi.HMACKey. It's
+	// unexported so that it doesn't leak out wherever tasks are reported.
+	key []byte
+
+	// digest, if non-nil, is the already-computed hash (without the salt) of
+	// an uploaded file, which is too big to hold on to as the Password. See
+	// HashApi.startUpload.
+	digest interface{}
+}
+
+// DefaultDelay is the artificial delay that HashApi adds to each hash unless
+// configured otherwise, giving the CPU time to plan its strategy.
+const DefaultDelay = 5 * time.Second
 
 // Run executes the task and satisfies the task.Interface API.
 func (h HashTask) Run() (interface{}, error) {
-	time_Sleep(5 * time.Second)
-	// sha512 for passwords? that's atypical.
-	bin := sha512.Sum512([]byte(h))
-	return base64.StdEncoding.EncodeToString(bin[:]), nil
+	return h.RunContext(context.Background())
+}
+
+// RunContext is like Run, but gives up on the delay as soon as the context is
+// done. That way shutdown doesn't have to wait for it.
+func (h HashTask) RunContext(ctx context.Context) (interface{}, error) {
+	if h.Delay > 0 {
+		if err := sleepContext(ctx, h.Delay); err != nil {
+			return nil, err
+		}
+	}
+	algo := h.Algo
+	if algo == "" {
+		algo = DefaultAlgorithm
+	}
+	// HashApi validates this before starting the task, so we shouldn't ever
+	// fail here.
+	if err := checkAlgorithms(algo); err != nil {
+		return nil, err
+	}
+	encoding := h.Encoding
+	if encoding == "" {
+		encoding = DefaultEncoding
+	}
+	result := h.digest
+	if result == nil {
+		var err error
+		result, err = hashInput(algo, encoding, h.Salt, h.key, h.Iterations, strings.NewReader(h.Password))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.Salt != "" {
+		return SaltedHash{Hash: result, Salt: h.Salt}, nil
+	}
+	return result, nil
+}
+
+// hashInput hashes the salt (see saltPrefix) followed by the input with each
+// of the comma-separated algorithms in a single pass over the input, and
+// encodes the result as described for HashTask (without the SaltedHash
+// wrapper). The key is only used for HMACs. Each digest is rehashed for the iterations after the
+// first, as described for HashTask.Iterations.
+func hashInput(algo, encoding, salt string, key []byte, iterations int, input io.Reader) (interface{}, error) {
+	encode := hashEncodings[encoding]
+	if encode == nil {
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	names := strings.Split(algo, ",")
+	hashers := make([]hash.Hash, len(names))
+	writers := make([]io.Writer, len(names))
+	for i, name := range names {
+		hasher, err := newHasher(name, key)
+		if err != nil {
+			return nil, err
+		}
+		hashers[i], writers[i] = hasher, hasher
+	}
+	all := io.MultiWriter(writers...)
+	io.WriteString(all, saltPrefix(salt))
+	if _, err := io.Copy(all, input); err != nil {
+		return nil, err
+	}
+
+	sum := func(hasher hash.Hash) []byte {
+		digest := hasher.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			hasher.Reset()
+			hasher.Write(digest)
+			digest = hasher.Sum(digest[:0])
+		}
+		return digest
+	}
+
+	if len(hashers) == 1 {
+		return encode(sum(hashers[0])), nil
+	}
+	results := make(map[string]string, len(names))
+	for i, name := range names {
+		results[name] = encode(sum(hashers[i]))
+	}
+	return results, nil
+}
+
+// saltPrefix is what's hashed ahead of the input for the salt: its length,
+// a colon and then the salt itself, e.g. "6:pepper". Just concatenating them
+// would be ambiguous, since the salt "ab" with the input "c" would hash the
+// same as the salt "a" with the input "bc". No salt is nothing at all, so that
+// unsalted hashes are just the hash of the input.
+func saltPrefix(salt string) string {
+	if salt == "" {
+		return ""
+	}
+	return strconv.Itoa(len(salt)) + ":" + salt
+}
+
+// SaltedHash is the result of a HashTask with a salt. Hash is whatever the
+// result would have been without a salt, i.e. a string or a map of them.
+type SaltedHash struct {
+	Hash interface{} `json:"hash"`
+	Salt string      `json:"salt"`
+}
+
+// sleepContext sleeps for the duration or until the context is done,
+// whichever comes first. It returns the context's error in the latter case.
+func sleepContext(ctx context.Context, dt time.Duration) error {
+	// A timer rather than a sleep, so that nothing is left behind sleeping
+	// when the context is done first.
+	timer := time_NewTimer(dt)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Type identifies hash tasks for the Manager's statistics. Different
+// algorithms have wildly different performance, so they're tracked separately.
+func (h HashTask) Type() string {
+	if h.Algo == "" {
+		return "hash:" + DefaultAlgorithm
+	}
+	return "hash:" + h.Algo
+}
+
+// ExpectedDuration is dominated by the artificial delay; the hashing itself is
+// negligible in comparison.
+func (h HashTask) ExpectedDuration() time.Duration { return h.Delay }
+
+// DurationEstimator may be implemented by tasks that can predict how long
+// they take to run, which is used to tell clients when to check back.
+type DurationEstimator interface {
+	ExpectedDuration() time.Duration
 }
 
 // Compile-time assertion that this satisfies the task.Interface API. This is
 // also enforced by it's usage with the task manager in the HashApi below.
-var _ task.Interface = HashTask("")
+var _ task.Interface = HashTask{}
+
+// TaskError may be implemented by errors returned from tasks to control how
+// GetResult reports the failure to clients. Task errors that don't implement
+// this are reported as a 500 with the code "internal".
+type TaskError interface {
+	error
+	HTTPStatus() int   // The HTTP status code of the response.
+	ErrorCode() string // A short, machine-readable, client-safe code.
+}
 
 // HashApi provides the api for hashing passwords:
-//   Start()     = POST /hash     --> response is the task id
-//   GetResult() = GET /hash/:id  --> response is the base64 sha512 hash
+//   Start()       = POST /hash        --> response is the task id
+//   GetResult()   = GET /hash/:id     --> response is the base64 hash, as JSON
+//                                         or text/plain (per Accept)
+//   Sync()        = POST /hash/sync   --> response is the hash, no polling
+//   Verify()      = POST /hash/verify --> response is whether the hash matches
+//   Batch()       = POST /hash/batch  --> response is the task ids
+//   WaitMany()    = GET /hash/batch   --> response is the results of ?ids=...
+//   Delete()      = DELETE /hash/:id  --> cancels and forgets the task
+//   List()        = GET /hash         --> response is all task ids and statuses
+//   Healthz()     = GET /healthz      --> response is whether it's serving
+//   TaskMetrics() = GET /debug/tasks  --> response is the task counts and timings
+//
+// Errors are reported as JSON too, see writeJSONError. (Except for the 405s
+// from the mux, which doesn't know any better.)
+//
+// The handlers expect to be registered on an http.ServeMux with those method
+// and path patterns, e.g. "GET /hash/{id}": the mux takes care of rejecting
+// other methods and of extracting the id.
 //
 // HashApi is intended to be the HTTP handling front-end to task.Manager and
 // HashTask, so business logic does not belong here -- only API stuff.
@@ -47,97 +342,1342 @@ type HashApi struct {
 	// interface here to make testing easier. But currently putting the actual
 	// implementation is fine.
 	Tasks task.Manager
+
+	// DefaultAlgo is the hash algorithm used for requests that don't specify
+	// one. If empty, DefaultAlgorithm is used.
+	DefaultAlgo string
+
+	// Delay is the artificial delay added to each hash task. If zero,
+	// DefaultDelay is used. Set it to a negative value to disable the delay.
+	Delay time.Duration
+
+	// PendingStatus, if non-zero, makes GetResult respond immediately with
+	// this status code and a Retry-After header if the result isn't ready yet,
+	// rather than blocking until it is. http.StatusTooEarly (425) is a good
+	// choice since clients and caching proxies know to retry it.
+	PendingStatus int
+
+	// PollTimeout is how long GetResult waits for a result before responding
+	// that it's still pending, when it's not blocking (see PendingStatus and
+	// the wait=false query parameter). Zero means not to wait at all. Either
+	// way, a polling client is never held up longer than this.
+	PollTimeout time.Duration
+
+	// MaxWait, if positive, caps how long GetResult blocks waiting for a
+	// result, after which it responds like PendingStatus would. It also caps
+	// the X-Max-Wait-Ms request header, which lets clients pick their own
+	// wait time (see DefaultMaxRequestedWait if it's not set).
+	MaxWait time.Duration
+
+	// ResultStatus, if non-zero, is the status code that GetResult uses for
+	// completed results instead of 200 OK. This is only for unusual proxy
+	// setups that need some other 2xx code. Raw byte results ignore this since
+	// their status depends on the requested Range.
+	ResultStatus int
+
+	// MaxBytesPerWindow, if positive, limits the total size of the inputs
+	// accepted for hashing in each ByteWindow (or minute, if unset). Once the
+	// budget is used up, Start rejects requests with 429 until the window
+	// rolls over. Per-request size limits don't stop a client from sending a
+	// sustained stream of large-ish inputs; this does.
+	MaxBytesPerWindow int64
+	ByteWindow        time.Duration
+
+	// Bytes, if non-nil, keeps the MaxBytesPerWindow budget and the
+	// BytesHashed total, so that several HashApis (e.g. one per listener) can
+	// share them and the limit applies to all of them together. Otherwise
+	// each HashApi keeps its own.
+	Bytes *ByteBudget
+
+	// MinLength and MaxLength, if positive, are the limits on the length (in
+	// bytes) of the input to hash, not including the salt. Start rejects
+	// anything else with 400. MaxLength keeps clients from using the server to
+	// hash huge inputs, which the 10 MB request limit alone doesn't prevent.
+	MinLength, MaxLength int
+
+	// HMACKey is the secret key for the hmac-* algorithms. If it's empty,
+	// requests for those fail with a 500 since it's the server that's
+	// misconfigured, not the request.
+	HMACKey []byte
+
+	// MaxFileSize limits the size of files uploaded or streamed to Start. If
+	// zero, DefaultMaxFileSize is used.
+	MaxFileSize int64
+
+	// MaxBatchSize limits the number of passwords in a Batch request. If zero,
+	// DefaultMaxBatchSize is used.
+	MaxBatchSize int
+
+	// WeakPasswords, if non-nil, is a list of known-weak passwords that Start
+	// rejects with 422 before doing any hashing.
+	WeakPasswords *PasswordList
+
+	// VerboseErrors includes the actual error messages in responses for
+	// internal errors, rather than a generic apology. That's convenient for
+	// internal-only services, but it can leak internal details to clients, so
+	// it's off by default.
+	VerboseErrors bool
+
+	// MaxWaiting, if positive, caps the number of GetResult requests that can
+	// be waiting for results at once. Beyond that, GetResult sheds load by
+	// responding with 503. Blocked waits hold a connection and goroutine each,
+	// which is a very different resource profile from the quick Start calls.
+	MaxWaiting int
+
+	// MaxInFlight, if positive, caps the number of tasks that can be started
+	// but unfinished at once. Beyond that, Start and Batch shed load by
+	// responding with 503, rather than queueing up work that the server can't
+	// keep up with. Start checks before even reading the request. Unlike the
+	// Manager's MaxQueued, this works without a worker pool too.
+	MaxInFlight int
+
+	// MaxIterations limits the 'iterations' that a Start request can ask for.
+	// If zero, DefaultMaxIterations is used.
+	MaxIterations int
+
+	// MaxSyncSize limits the size of the input (including the salt) of a
+	// Sync request. If zero, DefaultMaxSyncSize is used.
+	MaxSyncSize int
+
+	ownBytes ByteBudget // unless Bytes is set
+	waiting  atomic.Int64
+}
+
+// DefaultMaxFileSize is the largest file that can be uploaded for hashing
+// unless HashApi.MaxFileSize says otherwise.
+const DefaultMaxFileSize = 10 << 20
+
+// DefaultMaxIterations is the most iterations that a Start request can ask for
+// unless HashApi.MaxIterations says otherwise. That's on the order of 10ms of
+// CPU for the slower algorithms.
+const DefaultMaxIterations = 10000
+
+// DefaultMaxSyncSize is the largest input that a Sync request can hash unless
+// HashApi.MaxSyncSize says otherwise. Sync is meant for passwords and other
+// small inputs, not documents.
+const DefaultMaxSyncSize = 4 << 10
+
+// DefaultMaxBatchSize is the most passwords that a Batch request can have
+// unless HashApi.MaxBatchSize says otherwise.
+const DefaultMaxBatchSize = 100
+
+// DefaultMaxRequestedWait is the longest wait that clients can ask for with
+// the X-Max-Wait-Ms header unless HashApi.MaxWait says otherwise. Without a
+// cap, anyone could hold connections open for as long as they like.
+const DefaultMaxRequestedWait = time.Minute
+
+// BytesHashed returns the total size of all inputs accepted for hashing, by
+// all the HashApis sharing the Bytes.
+func (h *HashApi) BytesHashed() int64 { return h.bytes().Total() }
+
+// bytes returns the byte budget in effect, see Bytes.
+func (h *HashApi) bytes() *ByteBudget {
+	if h.Bytes != nil {
+		return h.Bytes
+	}
+	return &h.ownBytes
 }
 
 // Start is the API endpoint to start a new hash operation. The password to hash
-// is delivered via the POST form value 'password'. The hash operation is
-// started and the operation id is returned as a string.
+// is delivered via the POST form value 'password' and the optional POST form
+// value 'algo' selects the hash algorithm, or a comma-separated list of them.
+// The hash operation is started and the operation id is returned as a string.
+//
+// Despite the name, anything can be hashed: the optional POST form value
+// 'field' names a different form value to hash instead of 'password'.
+//
+// The optional POST form value 'salt' is prepended to the password before
+// hashing (see saltPrefix), and then reported along with the hash by
+// GetResult.
+//
+// The optional POST form value 'encoding' is "base64" (the default) or "hex",
+// and controls how GetResult reports the hash.
+//
+// Files can be hashed too: a multipart/form-data request with a 'file' part
+// hashes the file's contents instead of the password, see startUpload. Or an
+// application/octet-stream request hashes its whole body, see startStream.
+//
+// Instead of a form, the request can be a JSON object with the same fields,
+// e.g. {"password": "angryMonkey", "algo": "sha256", "iterations": 3}, with a
+// Content-Type of application/json. Numeric fields may be numbers or strings.
+//
+// Requests with an Idempotency-Key header can be retried safely, see
+// startTask.
 func (h *HashApi) Start(w http.ResponseWriter, r *http.Request) {
-	// Normally, a fancier mux would take care of this.
-	if r.Method != "POST" {
-		http.Error(w, "Not found", http.StatusNotFound)
+	// TODO(aroman) Auth checks here?
+
+	// TODO(aroman) Once the Manager can prioritize tasks, read an X-Priority
+	// header (or priority form field) here, validate it against the allowed
+	// range, default to normal, and pass it along so important clients'
+	// hashes jump the queue. If auth ever exists, it should also decide who
+	// may ask for high priority. Tasks do queue up behind MaxConcurrent, but
+	// they take turns in whatever order the semaphore lets them through, so
+	// there's no order for a priority to change yet.
+
+	if h.overloaded(w, 1) {
 		return
 	}
 
-	// TODO(aroman) Auth checks here?
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "multipart/form-data":
+		h.startUpload(w, r)
+		return
+	case "application/octet-stream":
+		h.startStream(w, r)
+		return
+	}
 
-	// Input size limited to ~10 MB by default:
-	// https://golang.org/pkg/net/http/#Request.ParseForm
-	password := r.FormValue("password")
+	hashTask, ok := h.hashRequest(w, r)
+	if !ok {
+		return
+	}
+	if !h.spend(w, len(hashTask.Salt)+len(hashTask.Password)) {
+		return
+	}
+
+	// TODO(aroman) If identical in-flight requests ever get deduplicated onto
+	// a single task, cap the number of requests sharing a task (429 beyond
+	// that) so that one hot input can't accumulate unbounded waiters.
+	h.startTask(w, r, hashTask)
+}
+
+// hashRequest reads the hash task from the form or JSON values of a Start or
+// Sync request. If that fails, the error response has been written already.
+// The input hasn't been paid for yet (see spend).
+func (h *HashApi) hashRequest(w http.ResponseWriter, r *http.Request) (HashTask, bool) {
+	values, err := startValues(w, r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON request: "+err.Error())
+		return HashTask{}, false
+	}
+	field := values("field")
+	if field == "" {
+		field = "password"
+	}
+	password := values(field)
 	if password == "" {
-		http.Error(w, "Missing password form field", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "missing_field", fmt.Sprintf("Missing %s form field", field))
+		return HashTask{}, false
+	}
+	if status, problem := h.checkInput(password); problem != "" {
+		writeJSONError(w, status, "invalid_input", fmt.Sprintf("The %s field %s", field, problem))
+		return HashTask{}, false
+	}
+
+	algo, encoding, ok := h.hashOptions(w, values)
+	if !ok {
+		return HashTask{}, false
+	}
+	iterations, ok := h.hashIterations(w, values)
+	if !ok {
+		return HashTask{}, false
+	}
+	hashTask := h.newTask(password, values("salt"), algo)
+	hashTask.Encoding = encoding
+	hashTask.Iterations = iterations
+	return hashTask, true
+}
+
+// Sync is the API endpoint to hash a small input within the request, for
+// scripts that don't want to bother with task ids and polling: POST
+// /hash/sync, with the same form or JSON values as Start. The response is a
+// 200 with the result, in the same format as GetResult's (including the
+// Accept negotiation).
+//
+// It still takes the full artificial delay, and every request ties up its
+// connection for that long, so it's limited: the salt and input can be at most
+// MaxSyncSize bytes together, and the requests count against MaxWaiting just
+// like the ones waiting in GetResult. If the client disconnects, the hash is
+// abandoned.
+func (h *HashApi) Sync(w http.ResponseWriter, r *http.Request) {
+	// TODO(aroman) Auth checks here?
+
+	contentType := negotiateResult(r.Header.Get("Accept"))
+	if contentType == "" {
+		writeJSONError(w, http.StatusNotAcceptable, "not_acceptable",
+			"Results are only available as application/json or text/plain.")
 		return
 	}
-	// TODO(aroman) Enforce other password requirements here?
+	// It's not a task, but it's new work all the same.
+	if h.Tasks.IsShuttingDown() {
+		h.startFailed(w, task.ErrShuttingDown)
+		return
+	}
+	done, ok := h.startWaiting(w)
+	if !ok {
+		return
+	}
+	defer done()
 
-	id, err := h.Tasks.Start(HashTask(password))
-	if err == task.ErrShuttingDown {
-		http.Error(w, "Unable to accept new requests: the server is shutting down.",
-			http.StatusServiceUnavailable)
+	hashTask, ok := h.hashRequest(w, r)
+	if !ok {
+		return
+	}
+	maxSize := h.MaxSyncSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSyncSize
+	}
+	if size := len(hashTask.Salt) + len(hashTask.Password); size > maxSize {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf(
+			"Synchronous hashes are limited to %d bytes, use POST /hash for larger inputs.", maxSize))
+		return
+	}
+	if !h.spend(w, len(hashTask.Salt)+len(hashTask.Password)) {
+		return
+	}
+
+	result, err := hashTask.RunContext(r.Context())
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		// The client went away, nobody's listening.
+		writeJSONError(w, http.StatusRequestTimeout, "request_failed", "Request failed, please try again.")
 		return
 	} else if err != nil {
+		log.Printf("ERROR: Synchronous hash failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal", "Sorry, something went wrong.")
+		return
+	}
+	if contentType == "text/plain" {
+		writePlainResult(w, http.StatusOK, result)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// startTask starts the hash task and responds with its id. Clients that retry
+// requests after network failures can set an Idempotency-Key header so that
+// they don't start duplicate tasks: requests with the same key get the same
+// task, for as long as it's kept around (see task.Manager.TTL).
+func (h *HashApi) startTask(w http.ResponseWriter, r *http.Request, hashTask HashTask) {
+	// NOTE(aroman) A retry with the same key but a different input gets the
+	// original task. The IETF draft says to reject that with a 422, but that
+	// would mean remembering a fingerprint of every request.
+	id, err := h.Tasks.StartOnce(r.Header.Get("Idempotency-Key"), hashTask)
+	if err != nil {
+		h.startFailed(w, err)
+		return
+	}
+
+	// Yay! The task was started.
+	h.started(w, id)
+}
+
+// started responds that the task was accepted. The Location header points at
+// where the result will be, per HTTP conventions, but the body is still just
+// the bare id since that's what existing clients expect.
+func (h *HashApi) started(w http.ResponseWriter, id task.Id) {
+	// NOTE(aroman) This is a path rather than a full URL: relative references
+	// are fine in Location (RFC 7231 §7.1.2), and building an absolute one
+	// from r.Host would be wrong behind most proxies anyway.
+	w.Header().Set("Location", resultPath(id))
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, string(id))
+}
+
+// resultPath is the path of the GetResult endpoint for the task id.
+func resultPath(id task.Id) string {
+	return "/hash/" + url.PathEscape(string(id))
+}
+
+// startUpload is Start for multipart/form-data requests, which upload a 'file'
+// to hash instead of a password. The file is hashed as it's read rather than
+// being held on to, so the other form values ('algo', 'salt' and 'encoding')
+// have to come before it. Browsers send the values in form order, so that just
+// means the file input should be last.
+func (h *HashApi) startUpload(w http.ResponseWriter, r *http.Request) {
+	maxSize := h.maxFileSize()
+	// Leave some room for the other form values and the multipart overhead.
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	parts, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_multipart", "Invalid multipart request: "+err.Error())
+		return
+	}
+	values := map[string]string{}
+	var file *multipart.Part
+	for file == nil {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "missing_field", "Missing file form field")
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_multipart", "Invalid multipart request: "+err.Error())
+			return
+		}
+		if part.FormName() == "file" {
+			file = part
+			continue
+		}
+		val, err := io.ReadAll(io.LimitReader(part, 64<<10))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_multipart", "Invalid multipart request: "+err.Error())
+			return
+		}
+		values[part.FormName()] = string(val)
+	}
+	lookup := func(name string) string { return values[name] }
+	h.startReader(w, r, lookup, file, "file", maxSize)
+}
+
+// startStream is Start for application/octet-stream requests, which hash the
+// raw request body. It's hashed as it's read, so memory use doesn't depend on
+// the size of the input. There's no form, so the other values ('algo', 'salt'
+// and 'encoding') come from the URL query instead, e.g.
+// POST /hash?algo=sha256.
+func (h *HashApi) startStream(w http.ResponseWriter, r *http.Request) {
+	h.startReader(w, r, r.URL.Query().Get, r.Body, "body", h.maxFileSize())
+}
+
+// maxFileSize is MaxFileSize or its default.
+func (h *HashApi) maxFileSize() int64 {
+	if h.MaxFileSize == 0 {
+		return DefaultMaxFileSize
+	}
+	return h.MaxFileSize
+}
+
+// startReader starts a task for the hash of everything read from the input,
+// with the options from values, once it's all been read. The input is called
+// 'what' in error messages and can be at most maxSize bytes.
+func (h *HashApi) startReader(w http.ResponseWriter, r *http.Request,
+	values func(string) string, input io.Reader, what string, maxSize int64) {
+	algo, encoding, ok := h.hashOptions(w, values)
+	if !ok {
+		return
+	}
+	iterations, ok := h.hashIterations(w, values)
+	if !ok {
+		return
+	}
+	salt := values("salt")
+	content := &io.LimitedReader{R: input, N: maxSize + 1}
+	digest, err := hashInput(algo, encoding, salt, h.HMACKey, iterations, content)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "read_failed",
+			fmt.Sprintf("Failed to read the %s: %v", what, err))
+		return
+	} else if content.N == 0 {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large",
+			fmt.Sprintf("The %s is too large: it must be at most %d bytes.", what, maxSize))
+		return
+	}
+	if !h.spend(w, len(salt)+int(maxSize+1-content.N)) {
+		return
+	}
+
+	hashTask := h.newTask("", salt, algo)
+	hashTask.Encoding = encoding
+	hashTask.Iterations = iterations // already applied, but for the record
+	hashTask.digest = digest
+	h.startTask(w, r, hashTask)
+}
+
+// hashOptions returns the hash algorithm and encoding for a Start request, or
+// responds with 400 and returns false if they're invalid.
+func (h *HashApi) hashOptions(w http.ResponseWriter, values func(string) string) (algo, encoding string, ok bool) {
+	algo = values("algo")
+	if algo == "" {
+		algo = h.DefaultAlgo
+	}
+	if algo == "" {
+		algo = DefaultAlgorithm
+	}
+	if err := checkAlgorithms(algo); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_algo", "Invalid algo form field: "+err.Error())
+		return "", "", false
+	}
+	if !h.checkHMACKey(w, algo) {
+		return "", "", false
+	}
+
+	encoding = values("encoding")
+	if encoding == "" {
+		encoding = DefaultEncoding
+	}
+	if hashEncodings[encoding] == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_encoding", fmt.Sprintf(
+			"Invalid encoding form field: must be base64 or hex, not %q", encoding))
+		return "", "", false
+	}
+	return algo, encoding, true
+}
+
+// hashIterations returns the number of iterations for a Start request, from
+// the optional 'iterations' value, or responds with a 400 and returns false if
+// it's invalid. It's bounded by MaxIterations, since every iteration costs CPU
+// that the artificial delay doesn't account for.
+func (h *HashApi) hashIterations(w http.ResponseWriter, values func(string) string) (int, bool) {
+	val := values("iterations")
+	if val == "" {
+		return 1, true
+	}
+	maxIterations := h.MaxIterations
+	if maxIterations == 0 {
+		maxIterations = DefaultMaxIterations
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 || n > maxIterations {
+		writeJSONError(w, http.StatusBadRequest, "invalid_iterations", fmt.Sprintf(
+			"Invalid iterations form field: must be between 1 and %d, not %q", maxIterations, val))
+		return 0, false
+	}
+	return n, true
+}
+
+// Batch is the API endpoint to start hashing several passwords at once:
+// POST /hash/batch. The request is a JSON array of the passwords, which are all
+// hashed with the default algorithm, and the response is a JSON array of their
+// task ids in the same order. Each one's result is retrieved by GetResult as
+// usual.
+//
+// The batch is all or nothing: if any password is rejected, none are hashed.
+func (h *HashApi) Batch(w http.ResponseWriter, r *http.Request) {
+	// TODO(aroman) Auth checks here?
+
+	var passwords []string
+	body := http.MaxBytesReader(w, r.Body, 10<<20)
+	if err := json.NewDecoder(body).Decode(&passwords); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON request: "+err.Error())
+		return
+	}
+	maxBatch := h.MaxBatchSize
+	if maxBatch == 0 {
+		maxBatch = DefaultMaxBatchSize
+	}
+	if len(passwords) == 0 || len(passwords) > maxBatch {
+		writeJSONError(w, http.StatusBadRequest, "invalid_batch", fmt.Sprintf("A batch "+
+			"must have between 1 and %d passwords, not %d.", maxBatch, len(passwords)))
+		return
+	}
+	if h.overloaded(w, len(passwords)) {
+		return
+	}
+	total := 0
+	for i, password := range passwords {
+		if password == "" {
+			writeJSONError(w, http.StatusBadRequest, "missing_field",
+				fmt.Sprintf("Password %d in the batch is empty", i+1))
+			return
+		}
+		if status, problem := h.checkInput(password); problem != "" {
+			writeJSONError(w, status, "invalid_input", fmt.Sprintf("Password %d in the batch %s", i+1, problem))
+			return
+		}
+		total += len(password)
+	}
+	if !h.spend(w, total) {
+		return
+	}
+
+	algo := h.DefaultAlgo
+	if algo == "" {
+		algo = DefaultAlgorithm
+	}
+	ids := make([]task.Id, len(passwords))
+	for i, password := range passwords {
+		id, err := h.Tasks.Start(h.newTask(password, "", algo))
+		if err != nil {
+			// Don't leave the start of the batch running if the rest of it
+			// can't be.
+			for _, id := range ids[:i] {
+				h.Tasks.Delete(id)
+			}
+			h.startFailed(w, err)
+			return
+		}
+		ids[i] = id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(ids)
+}
+
+// checkInput enforces the limits on what can be hashed (other than that it
+// can't be empty). If the input breaks one of them, this returns the status
+// code for the response and what's wrong with the input, phrased to follow the
+// input's name, e.g. "is too long: ...".
+func (h *HashApi) checkInput(input string) (status int, problem string) {
+	if h.MinLength > 0 && len(input) < h.MinLength {
+		return http.StatusBadRequest, fmt.Sprintf("is too short: it must be "+
+			"at least %d bytes.", h.MinLength)
+	}
+	if h.MaxLength > 0 && len(input) > h.MaxLength {
+		return http.StatusBadRequest, fmt.Sprintf("is too long: it must be "+
+			"at most %d bytes.", h.MaxLength)
+	}
+	if h.WeakPasswords != nil && h.WeakPasswords.Contains(input) {
+		return http.StatusUnprocessableEntity, "is too weak: it appears in a " +
+			"list of known weak passwords."
+	}
+	return 0, ""
+}
+
+// newTask creates the task to hash the input with the configured delay.
+func (h *HashApi) newTask(password, salt, algo string) HashTask {
+	delay := h.Delay
+	if delay == 0 {
+		delay = DefaultDelay
+	}
+	return HashTask{
+		Password: password,
+		Salt:     salt,
+		Algo:     algo,
+		Delay:    max(0, delay),
+		key:      h.HMACKey,
+	}
+}
+
+// checkHMACKey responds with a 500 and returns false if the algorithms include
+// an HMAC but there's no key for it.
+func (h *HashApi) checkHMACKey(w http.ResponseWriter, algo string) bool {
+	if len(h.HMACKey) > 0 || !usesHMAC(algo) {
+		return true
+	}
+	log.Printf("ERROR: Request for %s, but no HMAC key is configured: "+
+		"set -hmac-key or $%s", algo, hmacKeyEnv)
+	writeJSONError(w, http.StatusInternalServerError, "hmac_unavailable",
+		"HMAC is not available on this server.")
+	return false
+}
+
+// writeJSONError responds with the status and the error as JSON, e.g.
+// {"error":"No such task","code":"no_such_task"}, so that clients can handle
+// errors the same way as the other responses. The code is a short,
+// machine-readable reason for the error, while the message is for humans.
+func writeJSONError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}{msg, code})
+}
+
+// startFailed responds to a request whose hash task couldn't be started.
+func (h *HashApi) startFailed(w http.ResponseWriter, err error) {
+	if err == task.ErrShuttingDown {
+		writeJSONError(w, http.StatusServiceUnavailable, "shutting_down",
+			"Unable to accept new requests: the server is shutting down.")
+	} else if err == task.ErrQueueFull {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusServiceUnavailable, "queue_full",
+			"Too many hashes waiting to be computed, please try again later.")
+	} else {
 		log.Printf("ERROR: Attempting to start new hash: %v", err)
 		// Don't send internal errors to clients... unless it's an
 		// internal-only service.
-		http.Error(w, "Sorry, something went wrong.", http.StatusInternalServerError)
+		msg := "Sorry, something went wrong."
+		if h.VerboseErrors {
+			msg = fmt.Sprintf("Sorry, something went wrong: %v", err)
+		}
+		writeJSONError(w, http.StatusInternalServerError, "internal", msg)
+	}
+}
+
+// startValues returns a lookup for the values of a Start request, which come
+// from either a JSON object body or the POST form. The error is for a malformed
+// JSON body.
+//
+// Input size is limited to ~10 MB either way, see:
+// https://golang.org/pkg/net/http/#Request.ParseForm
+//
+// Values are only read from the POST body, never the URL query: URLs end up in
+// logs, proxies and browser history, which is no place for a password.
+func startValues(w http.ResponseWriter, r *http.Request) (func(string) string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return r.PostFormValue, nil
+	}
+	var raw map[string]interface{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20))
+	dec.UseNumber() // keep "iterations": 3 as "3", not "3e+00"
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	// JSON clients send numbers as numbers, so take those (and booleans) as
+	// their literal text, just like the form value would have been.
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[name] = v
+		case json.Number:
+			values[name] = v.String()
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		case nil:
+		default:
+			return nil, fmt.Errorf("%q must be a string or a number", name)
+		}
+	}
+	return func(name string) string { return values[name] }, nil
+}
+
+// Verify is the API endpoint to check a hash that the client computed on its
+// own. The request is a JSON object with the "input" to hash, the optional
+// "salt" and "algo" to use and the "expected" base64-encoded hash, and the
+// response is {"match": true} or {"match": false}.
+//
+// Unlike Start, this hashes synchronously and without the artificial delay:
+// a client verifying a hash has already done the work once.
+func (h *HashApi) Verify(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Input    string `json:"input"`
+		Salt     string `json:"salt"`
+		Algo     string `json:"algo"`
+		Expected string `json:"expected"`
+	}
+	// Same size limit as the form values in Start.
+	body := http.MaxBytesReader(w, r.Body, 10<<20)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON request: "+err.Error())
+		return
+	}
+	if req.Input == "" || req.Expected == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_field", "Both input and expected are required")
+		return
+	}
+	if req.Algo == "" {
+		req.Algo = h.DefaultAlgo
+	}
+	if req.Algo == "" {
+		req.Algo = DefaultAlgorithm
+	}
+	// Several algorithms would produce several hashes, but there's only one
+	// expected value to compare against.
+	if strings.Contains(req.Algo, ",") || checkAlgorithms(req.Algo) != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_algo",
+			fmt.Sprintf("Invalid algo: unknown hash algorithm %q", req.Algo))
+		return
+	}
+	if !h.checkHMACKey(w, req.Algo) {
+		return
+	}
+	if !h.spend(w, len(req.Salt)+len(req.Input)) {
 		return
 	}
 
-	// Yay! The task was started. Use 200 OK here? Maybe 202 Accepted?
-	w.WriteHeader(http.StatusAccepted)
-	// OCD REST fanatics might suggest returning the full URL path for the
-	// created resource: /hash/:id.  Whatever.
-	io.WriteString(w, string(id))
+	actual, _ := HashTask{Password: req.Input, Salt: req.Salt, Algo: req.Algo, key: h.HMACKey}.Run()
+	if salted, ok := actual.(SaltedHash); ok {
+		actual = salted.Hash
+	}
+	// Compare in constant time so that response timing doesn't reveal how
+	// much of the expected hash was right.
+	match := subtle.ConstantTimeCompare([]byte(actual.(string)), []byte(req.Expected)) == 1
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Match bool `json:"match"`
+	}{match})
+}
+
+// spend accounts for n bytes of input about to be hashed. If that exceeds the
+// configured budget, it responds with a 429 and returns false.
+func (h *HashApi) spend(w http.ResponseWriter, n int) bool {
+	window := h.ByteWindow
+	if window == 0 {
+		window = time.Minute
+	}
+	if !h.bytes().Spend(int64(n), h.MaxBytesPerWindow, window) {
+		w.Header().Set("Retry-After", fmt.Sprint(int(window.Seconds())))
+		writeJSONError(w, http.StatusTooManyRequests, "rate_limited",
+			"Too much data hashed recently, please try again later.")
+		return false
+	}
+	return true
 }
 
 // GetResult is the API endpoint to retrieve a hashed password via the
 // previously-provided task id.
 //
-// Currently, requests to this endpoint block until the hash is complete. It
-// could, alternatively, provide a short context expiration and return an
-// intermediate status code suggesting that it's not ready yet... but what
-// status code is that?  Maybe 102 (StatusProcessing)?
+// By default, requests to this endpoint block until the hash is complete. If
+// PendingStatus is set, it instead responds right away with that status code
+// when the hash isn't ready yet... but what status code is that? 425 (Too
+// Early) is a reasonable, if slightly off-label, choice.
 //
 // https://softwareengineering.stackexchange.com/questions/316208/http-status-code-for-still-processing
 // https://stackoverflow.com/questions/9794696/how-do-i-choose-a-http-status-code-in-rest-api-for-not-ready-yet-try-again-lat
+//
+// Clients can also opt out of blocking per request with ?wait=false, in which
+// case the pending response is a 202 Accepted unless PendingStatus says
+// otherwise. 102 (Processing) would be more literal, but it's an interim
+// response: net/http sends it and then a final 200 anyway, so it can't carry
+// the pending JSON body.
+//
+// Clients can also set the X-Max-Wait-Ms request header to the number of
+// milliseconds they're willing to wait, which overrides all of the above
+// within limits: it's capped by MaxWait (or DefaultMaxRequestedWait), and
+// when polling it can only shorten the PollTimeout, not lengthen it.
+//
+// With ?verbose=true, the result comes with details about how it was
+// computed, see writeVerbose.
 func (h *HashApi) GetResult(w http.ResponseWriter, r *http.Request) {
-	// Normally, a fancier mux would take care of this and id param extraction.
-	if r.Method != "GET" {
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
-	}
-	id := task.Id(strings.TrimPrefix(r.URL.Path, "/hash/"))
+	id := task.Id(r.PathValue("id"))
 	// TODO(aroman) id validation here?
 
 	// TODO(aroman) Auth checks here?
 
-	// Here we provide r.Context() which will wait around as long as the request
-	// is connected. If we want different semantics, we could provide a very
-	// short timeout here and, if the wait times out, then return a "it's still
-	// working, please come back later" response.
-	result, err := h.Tasks.Wait(r.Context(), id)
+	// Negotiate up front so that clients that won't be able to use the result
+	// don't have to wait for it.
+	contentType := negotiateResult(r.Header.Get("Accept"))
+	if contentType == "" {
+		writeJSONError(w, http.StatusNotAcceptable, "not_acceptable",
+			"Results are only available as application/json or text/plain.")
+		return
+	}
+
+	done, ok := h.startWaiting(w)
+	if !ok {
+		return
+	}
+	defer done()
+	ctx, cancel := h.waitContext(r)
+	defer cancel()
+	pendingStatus := h.PendingStatus
+	if pendingStatus == 0 {
+		pendingStatus = http.StatusAccepted
+	}
+	result, err := h.Tasks.Wait(ctx, id)
 	if err == task.ErrNoSuchTask {
-		http.Error(w, "No such task", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "no_such_task", "No such task")
+		return
+	} else if err != nil && ctx.Err() != nil && r.Context().Err() == nil {
+		// Our own deadline expired, not the request: the task is still going.
+		// This checks the contexts rather than the error, since a task that
+		// was cancelled or timed out fails with the same errors.
+		h.writePending(w, id, pendingStatus)
 		return
-	} else if err == context.DeadlineExceeded || err == context.Canceled {
+	} else if err == task.ErrAbandoned {
+		// We're shutting down and gave up on the task: it'll never finish.
+		writeJSONError(w, http.StatusServiceUnavailable, "shutting_down",
+			"Server is shutting down, please try again.")
+		return
+	} else if err != nil && r.Context().Err() != nil {
 		// The request went away. We don't really expect anyone to be listening
 		// to our error response.
-		http.Error(w, "Request failed, please try again.", http.StatusRequestTimeout)
+		writeJSONError(w, http.StatusRequestTimeout, "request_failed", "Request failed, please try again.")
 		return
 	} else if err != nil {
-		// TODO(aroman) Can handle task-specific errors here, which may involve
-		// sending error messages to the response.
-		log.Printf("ERROR: Failure waiting for task %#q: %v", id, err)
-		http.Error(w, "Sorry, something went wrong.", http.StatusInternalServerError)
+		// The task failed. Clients need to be able to distinguish that from
+		// transport failures, so report it as structured JSON.
+		status, failure := h.taskFailure(id, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(struct {
+			Id     task.Id      `json:"id"`
+			Status string       `json:"status"`
+			Error  *taskFailure `json:"error"`
+		}{id, "failed", failure})
+		return
+	}
+
+	if r.URL.Query().Get("verbose") == "true" {
+		h.writeVerbose(w, id, result)
+		return
+	}
+
+	// A task that succeeded without producing anything. Encoding that as a
+	// JSON null would leave clients guessing, so say so explicitly.
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Byte-addressable results are served raw, which also gives clients Range
+	// support (206 Partial Content, multiple ranges, 416 for bad ranges, etc)
+	// for resumable downloads of large results.
+	if content := byteContent(result); content != nil {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, content)
+		return
+	}
+
+	// Plain text is just the bare result, for easy shell scripting.
+	if contentType == "text/plain" {
+		status := http.StatusOK
+		if h.ResultStatus != 0 {
+			status = h.ResultStatus
+		}
+		writePlainResult(w, status, result)
 		return
 	}
 
 	// For the hash api, we expect the result to always be a human-readable
 	// string that we can write to the output. For other tasks, we'd probably
-	// want more careful inspection of the result. JSON-encoding could fail if
-	// the result is non-encodable, but we'll ignore that here. It's more likely
-	// to fail if the client disconnects before we finish writing our response,
-	// which we don't really care about.
+	// want more careful inspection of the result.
+	h.writeResult(w, id, result)
+}
+
+// writeResult responds with the JSON encoding of a task's result (or the
+// verbose wrapper of it). The encoding is buffered so that a result that can't
+// be encoded (e.g. a task that returned a channel or a NaN) gets a clean 500
+// rather than a 200 with half a body. Failing to write the response is more
+// likely, if the client disconnects before we finish, but we don't really care
+// about that.
+func (h *HashApi) writeResult(w http.ResponseWriter, id task.Id, result interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(result); err != nil {
+		log.Printf("ERROR: Cannot encode the result of task %#q: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal",
+			"Sorry, the result can't be reported.")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(result)
+	if h.ResultStatus != 0 {
+		w.WriteHeader(h.ResultStatus)
+	}
+	w.Write(buf.Bytes())
+}
+
+// writePlainResult responds with the bare hash of a result for text/plain.
+// Salted hashes are just the hash, since the client already knows the salt.
+// Anything else, such as the map of hashes for several algorithms, has no
+// obvious plain text form, so it's only available as JSON.
+func writePlainResult(w http.ResponseWriter, status int, result interface{}) {
+	if salted, ok := result.(SaltedHash); ok {
+		result = salted.Hash
+	}
+	text, ok := result.(string)
+	if !ok {
+		writeJSONError(w, http.StatusNotAcceptable, "not_acceptable",
+			"This result is only available as application/json.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, text+"\n")
 }
+
+// negotiateResult picks the content type of GetResult's response from the
+// request's Accept header: "application/json" (the default) or "text/plain".
+// It returns "" if the client doesn't accept either.
+//
+// Only the successful result is negotiated. Errors are always JSON, as are
+// ?verbose=true and raw byte results, which are application/octet-stream.
+//
+// TODO(aroman): The specificity rules of RFC 9110 aren't implemented, e.g.
+// "text/*;q=0.5, text/plain;q=0" should rule out text/plain. Nobody sends
+// those though.
+func negotiateResult(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return "application/json"
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		var candidate string
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			candidate = "application/json"
+		case "text/plain", "text/*":
+			candidate = "text/plain"
+		default:
+			continue
+		}
+		// On a tie, JSON wins since it's the default.
+		if q > bestQ || (q == bestQ && q > 0 && candidate == "application/json") {
+			best, bestQ = candidate, q
+		}
+	}
+	return best
+}
+
+// writeVerbose responds with the result wrapped in an object with the details
+// of how it was computed, for GetResult's ?verbose=true:
+//
+//	{"result": "...", "duration_ms": 5002, "algo": "sha512", "iterations": 1}
+//
+// The algorithm and iterations are the ones that were actually used, including
+// server-side defaults, so that clients can reproduce the hash. The duration is how long
+// the task ran for, which is missing if that's unknown (e.g. for results
+// loaded from the Store).
+func (h *HashApi) writeVerbose(w http.ResponseWriter, id task.Id, result interface{}) {
+	resp := struct {
+		Result     interface{} `json:"result"`
+		DurationMs *int64      `json:"duration_ms,omitempty"`
+		Algo       string      `json:"algo,omitempty"`
+		Iterations int         `json:"iterations,omitempty"`
+	}{Result: result}
+	if info, err := h.Tasks.Info(id); err == nil {
+		if !info.Started.IsZero() {
+			ms := int64(info.Finished.Sub(info.Started) / time.Millisecond)
+			resp.DurationMs = &ms
+		}
+		if hashTask, ok := info.Task.(HashTask); ok {
+			resp.Algo = hashTask.Algo
+			resp.Iterations = max(1, hashTask.Iterations)
+		}
+	}
+	h.writeResult(w, id, resp)
+}
+
+// List is the API endpoint to list all of the tasks and their status, but not
+// their results: GET /hash. The response is a JSON array of objects with the
+// "id" and "status" of each task, oldest first.
+//
+// Anyone who knows a task's id can fetch its result, so this is only meant for
+// debugging and admin tools.
+func (h *HashApi) List(w http.ResponseWriter, r *http.Request) {
+	type taskStatus struct {
+		Id     task.Id         `json:"id"`
+		Status task.TaskStatus `json:"status"`
+	}
+	list := []taskStatus{} // an empty list, not null
+	for _, info := range h.Tasks.List() {
+		list = append(list, taskStatus{info.Id, info.Status})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// startWaiting counts the request against MaxWaiting, or responds with 503 and
+// returns false if there are too many already. Otherwise call done once the
+// request is no longer waiting.
+//
+// Waiting requests are cheap, but not free: each holds a connection and a
+// goroutine (or several, for WaitMany).
+func (h *HashApi) startWaiting(w http.ResponseWriter) (done func(), ok bool) {
+	if h.MaxWaiting <= 0 {
+		return func() {}, true
+	}
+	if h.waiting.Add(1) > int64(h.MaxWaiting) {
+		h.waiting.Add(-1)
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusServiceUnavailable, "too_many_waiting",
+			"Too many requests waiting for results, please try again later.")
+		return nil, false
+	}
+	return func() { h.waiting.Add(-1) }, true
+}
+
+// overloaded responds with a 503 if starting n more tasks would put more than
+// MaxInFlight tasks in flight.
+//
+// NOTE(aroman) This is a check-then-act, so concurrent Starts can overshoot
+// the limit a bit. That's fine for shedding load; the Manager's MaxQueued is
+// the strict limit.
+//
+// TODO(aroman) An Idempotency-Key retry of a task that's already in flight
+// doesn't start anything new, but it's rejected here all the same.
+func (h *HashApi) overloaded(w http.ResponseWriter, n int) bool {
+	if h.MaxInFlight <= 0 || h.Tasks.InFlight()+n <= h.MaxInFlight {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	writeJSONError(w, http.StatusServiceUnavailable, "overloaded",
+		"Too many hashes in progress, please try again later.")
+	return true
+}
+
+// waitContext is the context to wait for results with. We provide
+// r.Context(), which will wait around as long as the request is connected,
+// unless we're configured to return a "it's still working, please come back
+// later" response instead or the client asks for a shorter wait.
+func (h *HashApi) waitContext(r *http.Request) (context.Context, context.CancelFunc) {
+	wait := time.Duration(-1) // forever
+	limit := h.MaxWait
+	if limit <= 0 {
+		limit = DefaultMaxRequestedWait
+	}
+	if h.PendingStatus != 0 || r.URL.Query().Get("wait") == "false" {
+		// Only check whether the result is available (soon), don't wait for it.
+		wait = h.PollTimeout
+		// Polling is there to keep clients from tying up connections, so
+		// they don't get to opt out of it.
+		limit = min(limit, h.PollTimeout)
+	} else if h.MaxWait > 0 {
+		wait = h.MaxWait
+	}
+	// Bad values are ignored rather than rejected: the client still gets a
+	// result, just not with its preferred timing.
+	if ms, err := strconv.Atoi(r.Header.Get("X-Max-Wait-Ms")); err == nil && ms >= 0 {
+		// Compare as milliseconds, since huge values would overflow the
+		// time.Duration.
+		if ms >= int(limit/time.Millisecond) {
+			wait = limit
+		} else {
+			wait = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if wait < 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), wait)
+}
+
+// taskFailure is how a failed task's error is reported to clients.
+type taskFailure struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// taskFailure logs the task's error and returns the status code and error to
+// report. The actual error message may contain internal details, so only the
+// code goes out unless VerboseErrors is set.
+//
+// Tasks that were cancelled (see CancelAll) or that ran out of time (see
+// task.Manager.StartWithTimeout) fail with the context errors. Those are
+// final, so they get codes of their own rather than looking like the wait
+// for the result was cut short.
+func (h *HashApi) taskFailure(id task.Id, err error) (int, *taskFailure) {
+	log.Printf("ERROR: Failure waiting for task %#q: %v", id, err)
+	status, failure := http.StatusInternalServerError, &taskFailure{Code: "internal"}
+	var taskErr TaskError
+	switch {
+	case errors.As(err, &taskErr):
+		status, failure.Code = taskErr.HTTPStatus(), taskErr.ErrorCode()
+	case errors.Is(err, context.Canceled):
+		status, failure.Code = http.StatusServiceUnavailable, "cancelled"
+	case errors.Is(err, context.DeadlineExceeded):
+		status, failure.Code = http.StatusGatewayTimeout, "timeout"
+	}
+	if h.VerboseErrors {
+		failure.Message = err.Error()
+	}
+	return status, failure
+}
+
+// WaitMany is the API endpoint to wait for several results at once:
+// GET /hash/batch?ids=ID1,ID2,... It complements Batch. The response is a JSON
+// object with an entry for each id, like
+//
+//	{"ID1": {"status": "done", "result": "..."},
+//	 "ID2": {"status": "failed", "error": {"code": "internal"}},
+//	 "ID3": {"status": "pending"},
+//	 "ID4": {"status": "not_found"}}
+//
+// It waits for all of the tasks together, for as long as GetResult would wait
+// for one of them. Whichever ones aren't done by then are reported as
+// pending, so a client can ask again for just those.
+func (h *HashApi) WaitMany(w http.ResponseWriter, r *http.Request) {
+	// TODO(aroman) Auth checks here?
+
+	var ids []task.Id
+	seen := map[task.Id]bool{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id != "" && !seen[task.Id(id)] {
+			seen[task.Id(id)] = true
+			ids = append(ids, task.Id(id))
+		}
+	}
+	maxBatch := h.MaxBatchSize
+	if maxBatch == 0 {
+		maxBatch = DefaultMaxBatchSize
+	}
+	if len(ids) == 0 || len(ids) > maxBatch {
+		writeJSONError(w, http.StatusBadRequest, "invalid_batch", fmt.Sprintf("Must "+
+			"wait for between 1 and %d ids, not %d.", maxBatch, len(ids)))
+		return
+	}
+
+	done, ok := h.startWaiting(w)
+	if !ok {
+		return
+	}
+	defer done()
+	ctx, cancel := h.waitContext(r)
+	defer cancel()
+
+	type entry struct {
+		Status string       `json:"status"`
+		Result interface{}  `json:"result,omitempty"`
+		Error  *taskFailure `json:"error,omitempty"`
+	}
+	entries := make([]entry, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := h.Tasks.Wait(ctx, id)
+			switch {
+			case err == nil:
+				entries[i] = entry{Status: "done", Result: result}
+			case err == task.ErrNoSuchTask:
+				entries[i] = entry{Status: "not_found"}
+			case ctx.Err() != nil:
+				// Our wait is over, not the task, see GetResult.
+				entries[i] = entry{Status: "pending"}
+			case err == task.ErrAbandoned:
+				entries[i] = entry{Status: "failed", Error: &taskFailure{Code: "shutting_down"}}
+			default:
+				_, failure := h.taskFailure(id, err)
+				entries[i] = entry{Status: "failed", Error: failure}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r.Context().Err() != nil {
+		// The request went away, see GetResult.
+		writeJSONError(w, http.StatusRequestTimeout, "request_failed", "Request failed, please try again.")
+		return
+	}
+	resp := make(map[task.Id]entry, len(ids))
+	for i, id := range ids {
+		resp[id] = entries[i]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Delete is the API endpoint to cancel a hash operation, or to forget about
+// its result once it's no longer needed: DELETE /hash/:id. It responds with
+// 204 No Content, or 404 if there's no such task.
+func (h *HashApi) Delete(w http.ResponseWriter, r *http.Request) {
+	id := task.Id(r.PathValue("id"))
+
+	// TODO(aroman) Auth checks here? Anyone who knows the id can delete it.
+
+	if err := h.Tasks.Delete(id); err == task.ErrNoSuchTask {
+		writeJSONError(w, http.StatusNotFound, "no_such_task", "No such task")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CancelAll is the panic button for shedding load when the server is melting
+// down: POST /admin/cancel-all cancels every task that hasn't completed yet
+// (see task.Manager.CancelAll), and the clients waiting for them get errors.
+// It responds with how many were cancelled and how many had to be skipped
+// because they can't be stopped:
+//
+//	{"cancelled": 12, "skipped": 0}
+//
+// It must only be served behind admin auth, see requireToken.
+func (h *HashApi) CancelAll(w http.ResponseWriter, r *http.Request) {
+	cancelled, skipped := h.Tasks.CancelAll()
+	log.Printf("WARNING: Cancelled %d tasks (%d skipped) for %s", cancelled, skipped, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Cancelled int `json:"cancelled"`
+		Skipped   int `json:"skipped"`
+	}{cancelled, skipped})
+}
+
+// Healthz is the health check endpoint for load balancers and orchestrators:
+// GET /healthz. It responds with 200 and {"status":"ok"} normally, but 503 and
+// {"status":"draining"} once the task manager is shutting down so that new
+// traffic is routed elsewhere, while the clients of the unfinished tasks can
+// still get their results (see drain in main).
+func (h *HashApi) Healthz(w http.ResponseWriter, r *http.Request) {
+	status, code := "ok", http.StatusOK
+	if h.Tasks.IsShuttingDown() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{status})
+}
+
+// TaskMetrics reports how many tasks are queued, running, completed and failed
+// as JSON, along with how long they wait in the queue and run on average: GET
+// /debug/tasks. A growing queue means that the server isn't keeping up.
+func (h *HashApi) TaskMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(h.Tasks.Metrics())
+}
+
+// writePending responds that the task is still processing, including an
+// estimate of when it will be done if there's a reasonable way to guess.
+func (h *HashApi) writePending(w http.ResponseWriter, id task.Id, status int) {
+	resp := struct {
+		Status string `json:"status"`
+		EtaMs  int64  `json:"eta_ms,omitempty"`
+	}{Status: "processing"}
+	retryAfter := 1
+	if eta := h.estimateRemaining(id); eta > 0 {
+		resp.EtaMs = int64(eta / time.Millisecond)
+		retryAfter = int((eta + time.Second - 1) / time.Second) // round up
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// estimateRemaining guesses how much longer the task will take, or returns 0
+// if it has no idea. Tasks that know how long they take can say so via
+// DurationEstimator, otherwise the average run time of that type of task is
+// used.
+func (h *HashApi) estimateRemaining(id task.Id) time.Duration {
+	info, err := h.Tasks.Info(id)
+	if err != nil {
+		return 0
+	}
+	var expected time.Duration
+	if est, ok := info.Task.(DurationEstimator); ok {
+		expected = est.ExpectedDuration()
+	} else {
+		expected = h.Tasks.RunStats()[info.Type].Average()
+	}
+	if info.Started.IsZero() {
+		return expected
+	}
+	// If it's overdue, we're clueless.
+	return max(0, expected-time_Now().Sub(info.Started))
+}
+
+// byteContent returns a seekable reader for task results that are raw bytes,
+// either a []byte or something like a *bytes.Reader or *io.SectionReader. It
+// returns nil for other results.
+func byteContent(result interface{}) io.ReadSeeker {
+	switch res := result.(type) {
+	case []byte:
+		return bytes.NewReader(res)
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return io.NewSectionReader(res, 0, res.Size())
+	}
+	return nil
+}
+
+// ByteBudget tracks how many bytes have been spent in the current fixed time
+// window, and in total. A sliding window would be more accurate, but a fixed
+// window is good enough to stop sustained abuse. The zero value is ready to
+// use.
+type ByteBudget struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	spent       int64
+	total       atomic.Int64
+}
+
+// Spend records n bytes against the budget and returns true, unless that would
+// exceed max bytes in the current window, in which case nothing is recorded and
+// it returns false. A non-positive max means there's no limit.
+func (b *ByteBudget) Spend(n, max int64, window time.Duration) bool {
+	if max > 0 {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if now := time_Now(); now.Sub(b.windowStart) >= window {
+			b.windowStart, b.spent = now, 0
+		}
+		if b.spent+n > max {
+			return false
+		}
+		b.spent += n
+	}
+	b.total.Add(n)
+	return true
+}
+
+// Total returns the number of bytes spent so far, in all windows.
+func (b *ByteBudget) Total() int64 { return b.total.Load() }
@@ -1,32 +1,77 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/augustoroman/hashex/task"
 )
 
 func TestHashTask(t *testing.T) {
-	defer func() { time_Sleep = time.Sleep }() // Restore time_Sleep after this test.
+	defer func() { time_NewTimer = time.NewTimer }() // Restore time_NewTimer after this test.
 	var sleepAmount time.Duration
-	time_Sleep = func(dt time.Duration) { sleepAmount = dt }
+	time_NewTimer = func(dt time.Duration) *time.Timer {
+		sleepAmount = dt
+		return time.NewTimer(0)
+	}
 
 	t.Run("gives the CPU five seconds to plan it's strategy", func(t *testing.T) {
-		HashTask("xyz").Run()
+		HashTask{Password: "xyz", Delay: DefaultDelay}.Run()
 		if sleepAmount != 5*time.Second {
 			t.Errorf("Hash task sleep the right amount: %v", sleepAmount)
 		}
 	})
+	t.Run("doesn't sleep at all without a delay", func(t *testing.T) {
+		sleepAmount = -1
+		HashTask{Password: "xyz"}.Run()
+		if sleepAmount != -1 {
+			t.Errorf("Hash task slept anyway: %v", sleepAmount)
+		}
+	})
+	t.Run("gives up on the delay when the context is done", func(t *testing.T) {
+		var timer *time.Timer
+		defer func(restore func(time.Duration) *time.Timer) { time_NewTimer = restore }(time_NewTimer)
+		time_NewTimer = func(time.Duration) *time.Timer {
+			timer = time.NewTimer(time.Hour)
+			return timer
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		res, err := HashTask{Password: "xyz", Delay: DefaultDelay}.RunContext(ctx)
+		if err != context.Canceled {
+			t.Errorf("Wrong output: res=%#v err=%v", res, err)
+		}
+		// Nothing's left behind waiting for the delay.
+		if timer == nil || timer.Stop() {
+			t.Errorf("The delay's timer is still running")
+		}
+	})
 	t.Run("computes the base64-encoded sha512 hash as string", func(t *testing.T) {
 		const (
 			input    = "angryMonkey"
 			expected = `ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q==`
 		)
 
-		res, err := HashTask(input).Run()
+		res, err := HashTask{Password: input}.Run()
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -37,19 +82,237 @@ func TestHashTask(t *testing.T) {
 			t.Errorf("Wrong output:\nHave: %#q\nWant: %#q", strval, expected)
 		}
 	})
+	t.Run("computes several hashes at once", func(t *testing.T) {
+		res, err := HashTask{Password: "angryMonkey", Algo: "crc32,sha512"}.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{
+			"crc32":  "nPgoCg==",
+			"sha512": "ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q==",
+		}
+		if !reflect.DeepEqual(res, expected) {
+			t.Errorf("Wrong output:\nHave: %#v\nWant: %#v", res, expected)
+		}
+	})
+	t.Run("salts the password", func(t *testing.T) {
+		res1, _ := HashTask{Password: "angryMonkey", Salt: "pepper"}.Run()
+		res2, _ := HashTask{Password: "angryMonkey", Salt: "paprika"}.Run()
+		unsalted, _ := HashTask{Password: "angryMonkey"}.Run()
+		salted1, ok1 := res1.(SaltedHash)
+		salted2, ok2 := res2.(SaltedHash)
+		if !ok1 || !ok2 {
+			t.Fatalf("Expected SaltedHash results: %#v %#v", res1, res2)
+		}
+		if salted1.Salt != "pepper" || salted2.Salt != "paprika" {
+			t.Errorf("Wrong salts reported: %#v %#v", salted1, salted2)
+		}
+		if salted1.Hash == salted2.Hash || salted1.Hash == unsalted {
+			t.Errorf("Salt didn't change the hash: %#v %#v %#v", salted1, salted2, unsalted)
+		}
+		expected, _ := HashTask{Password: "6:pepperangryMonkey"}.Run()
+		if salted1.Hash != expected {
+			t.Errorf("Salt should be prepended: %#v != %#v", salted1.Hash, expected)
+		}
+
+		// Moving the boundary between the salt and password changes the hash.
+		ab, _ := HashTask{Password: "c", Salt: "ab"}.Run()
+		a, _ := HashTask{Password: "bc", Salt: "a"}.Run()
+		if ab.(SaltedHash).Hash == a.(SaltedHash).Hash {
+			t.Errorf("Salt and password are ambiguous: %#v %#v", ab, a)
+		}
+	})
+	t.Run("supports the common algorithms", func(t *testing.T) {
+		for algo, expected := range map[string]string{
+			"sha256":   "/iKaK4dQuFt0w2h6u20dpZQ7EPaM30pdx/sWN4BXIR8=",
+			"sha1":     "lN0RRs9qtGDQ9ycABlQZXeJYYp4=",
+			"md5":      "9R7T/2LRbbkJrnNRIuP9Ag==",
+			"sha3-256": "PACzGW5c2WPdi1j5/xdBoUVwWEtWaDmN09WxlFs9l38=",
+			"sha3-512": "mI69WEOKBqrPpD70UoCZngg7gW57kTMCU6H0pPPG9tB8SrDurArkzvspjhu8/PJ/Q34NFEmKce1VZ42D41Z+Lg==",
+		} {
+			res, err := HashTask{Password: "angryMonkey", Algo: algo}.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != expected {
+				t.Errorf("Wrong %s output:\nHave: %#q\nWant: %#q", algo, res, expected)
+			}
+		}
+	})
+	t.Run("computes HMACs with the key", func(t *testing.T) {
+		key := []byte("secret")
+		for algo, expected := range map[string]string{
+			"hmac-sha512": "qzITTA1fk6QbuCV/0jPvBodemDRSNCVVYFjQz2vHoMrHrsBtkQGrkTQuAmGHz4smmCm+OvuujzpKuQa/k1g5tg==",
+			"hmac-sha256": "6DeHY171gNaYSlRS13a68ksFRF5A7vfPZzciGSxOorg=",
+		} {
+			res, err := HashTask{Password: "angryMonkey", Algo: algo, key: key}.Run()
+			if err != nil || res != expected {
+				t.Errorf("Wrong %s output: res=%#q err=%v", algo, res, err)
+			}
+		}
+		if res, err := (HashTask{Password: "angryMonkey", Algo: "hmac-sha512"}).Run(); err != ErrNoHMACKey {
+			t.Errorf("Computed an HMAC without a key: res=%#q err=%v", res, err)
+		}
+	})
+	t.Run("stretches the hash with iterations", func(t *testing.T) {
+		once, _ := HashTask{Password: "angryMonkey", Algo: "sha256"}.Run()
+		for _, iterations := range []int{0, 1} {
+			if res, _ := (HashTask{Password: "angryMonkey", Algo: "sha256", Iterations: iterations}).Run(); res != once {
+				t.Errorf("%d iterations aren't just one hash: %#q != %#q", iterations, res, once)
+			}
+		}
+
+		// Each iteration rehashes the raw digest, and the salt is only part of
+		// the first one.
+		digest := sha256.Sum256([]byte("6:pepperangryMonkey"))
+		for i := 1; i < 3; i++ {
+			digest = sha256.Sum256(digest[:])
+		}
+		expected := base64.StdEncoding.EncodeToString(digest[:])
+		task := HashTask{Password: "angryMonkey", Salt: "pepper", Algo: "sha256", Iterations: 3}
+		for i := 0; i < 2; i++ { // and it's deterministic
+			res, err := task.Run()
+			if salted, _ := res.(SaltedHash); err != nil || salted.Hash != expected {
+				t.Errorf("Wrong output: res=%#v err=%v, want %#q", res, err, expected)
+			}
+		}
+
+		// Several algorithms are stretched independently.
+		res, _ := HashTask{Password: "angryMonkey", Algo: "md5,sha256", Iterations: 3}.Run()
+		alone, _ := HashTask{Password: "angryMonkey", Algo: "sha256", Iterations: 3}.Run()
+		if hashes, _ := res.(map[string]string); hashes["sha256"] != alone || alone == once {
+			t.Errorf("Didn't stretch each algorithm: %#v vs %#q", res, alone)
+		}
+	})
+	t.Run("encodes the hash as hex if requested", func(t *testing.T) {
+		task := HashTask{Password: "angryMonkey", Algo: "md5", Encoding: "hex"}
+		if res, err := task.Run(); err != nil || res != "f51ed3ff62d16db909ae735122e3fd02" {
+			t.Errorf("Wrong result: res=%#v err=%v", res, err)
+		}
+		task.Encoding = "rot13"
+		if res, err := task.Run(); err == nil {
+			t.Errorf("Accepted an unknown encoding: %#v", res)
+		}
+	})
+	t.Run("uses the requested algorithm", func(t *testing.T) {
+		res, err := HashTask{Password: "angryMonkey", Algo: "sha512-tree"}.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := newTreeHash(sha512.New)
+		tree.Write([]byte("angryMonkey"))
+		if expected := base64.StdEncoding.EncodeToString(tree.Sum(nil)); res != expected {
+			t.Errorf("Wrong output:\nHave: %#q\nWant: %#q", res, expected)
+		}
+	})
+	t.Run("runs on a typed manager", func(t *testing.T) {
+		var tm task.TypedManager[string]
+		id, err := tm.Start(stringHash{HashTask{Password: "angryMonkey"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		const expected = `ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q==`
+		if res, err := tm.Wait(context.Background(), id); err != nil || res != expected {
+			t.Errorf("Wrong output: res=%#q err=%v", res, err)
+		}
+		if stats := tm.RunStats(); stats["hash:sha512"].Count != 1 {
+			t.Errorf("Wrong task type in the stats: %v", stats)
+		}
+	})
 }
 
+// stringHash is a HashTask whose result is always a string, which it is as
+// long as it's unsalted and uses a single algorithm.
+type stringHash struct{ HashTask }
+
+func (s stringHash) Run() (string, error) { return s.RunContext(context.Background()) }
+func (s stringHash) RunContext(ctx context.Context) (string, error) {
+	res, err := s.HashTask.RunContext(ctx)
+	str, _ := res.(string)
+	return str, err
+}
+
+// withSequentialIds makes the api use predictable task ids, see
+// task.SequentialIds.
+func withSequentialIds(api *HashApi) *HashApi {
+	api.Tasks.IdGenerator = task.SequentialIds()
+	return api
+}
+
+// jsonError decodes an error response from writeJSONError, failing the test if
+// it isn't one.
+func jsonError(t *testing.T, w *httptest.ResponseRecorder) (code, msg string) {
+	t.Helper()
+	var resp struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&resp); err != nil || resp.Error == "" || resp.Code == "" {
+		t.Errorf("Not a JSON error (%v): %#q", err, w.Body.String())
+	}
+	return resp.Code, resp.Error
+}
+
+// serve routes the request to the api through the same mux that main uses, in
+// dev mode so that every endpoint is available.
+func serve(api *HashApi, w http.ResponseWriter, r *http.Request) {
+	newMux(api, &EndPointStatsTracker{}, muxConfig{DevMode: true}).ServeHTTP(w, r)
+}
+
+// blockingTask doesn't finish until the channel is closed.
+type blockingTask chan struct{}
+
+func (b blockingTask) Run() (interface{}, error) {
+	<-b
+	return "finished", nil
+}
+
+// bytesTask and readerTask return their content as raw bytes.
+type bytesTask string
+type readerTask string
+
+func (b bytesTask) Run() (interface{}, error)  { return []byte(b), nil }
+func (r readerTask) Run() (interface{}, error) { return strings.NewReader(string(r)), nil }
+
+// estimatedTask is a blockingTask that knows how long it (supposedly) takes.
+type estimatedTask struct {
+	blockingTask
+	duration time.Duration
+}
+
+func (e estimatedTask) ExpectedDuration() time.Duration { return e.duration }
+
+// chanTask returns a result that can't be encoded as JSON.
+type chanTask struct{}
+
+func (chanTask) Run() (interface{}, error) { return make(chan int), nil }
+
+// failingTask always fails with the given error.
+type failingTask struct{ err error }
+
+func (f failingTask) Run() (interface{}, error) { return nil, f.err }
+
+// quotaError is a TaskError.
+type quotaError struct{}
+
+func (quotaError) Error() string     { return "quota exceeded for user bob" }
+func (quotaError) HTTPStatus() int   { return http.StatusPaymentRequired }
+func (quotaError) ErrorCode() string { return "quota" }
+
 func TestHashApi(t *testing.T) {
-	defer func() { time_Sleep = time.Sleep }() // Restore time_Sleep after this test.
-	time_Sleep = func(dt time.Duration) {}     // don't make tests take 5 sec.
+	defer func() { time_NewTimer = time.NewTimer }() // Restore time_NewTimer after this test.
+	noDelay := func(time.Duration) *time.Timer { return time.NewTimer(0) }
+	time_NewTimer = noDelay // don't make tests take 5 sec.
 
 	t.Run("Start", func(t *testing.T) {
 		t.Run("returns incrementing ids", func(t *testing.T) {
-			api := &HashApi{}
+			api := withSequentialIds(&HashApi{})
 			input := strings.NewReader("password=foobar")
 			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
 			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			api.Start(w, r)
+			serve(api, w, r)
 			if w.Code != 202 || w.Body.String() != "1" {
 				t.Fatalf("Wrong output: status=%d body=%s", w.Code, w.Body.String())
 			}
@@ -57,17 +320,516 @@ func TestHashApi(t *testing.T) {
 			input = strings.NewReader("password=foobar")
 			w, r = httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
 			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			api.Start(w, r)
+			serve(api, w, r)
 			if w.Code != 202 || w.Body.String() != "2" {
 				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
 			}
 		})
+		t.Run("honors Idempotency-Key", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			start := func(key string) string {
+				input := strings.NewReader("password=angryMonkey")
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if key != "" {
+					r.Header.Set("Idempotency-Key", key)
+				}
+				serve(api, w, r)
+				if w.Code != 202 {
+					t.Fatalf("Wrong status: %d %s", w.Code, w.Body.String())
+				}
+				return w.Body.String()
+			}
+			if first, again := start("abc"), start("abc"); first != "1" || again != "1" {
+				t.Errorf("Wrong ids for a retry: %s %s", first, again)
+			}
+			if other, none := start("xyz"), start(""); other != "2" || none != "3" {
+				t.Errorf("Wrong ids for new requests: %s %s", other, none)
+			}
+			if n := len(api.Tasks.List()); n != 3 {
+				t.Errorf("Wrong number of tasks: %d", n)
+			}
+		})
+		t.Run("points the Location header at the result", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			input := strings.NewReader("password=angryMonkey")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+			loc := w.Header().Get("Location")
+			if w.Code != 202 || loc != "/hash/1" || w.Body.String() != "1" {
+				t.Fatalf("Wrong output: status=%d location=%#q body=%#q",
+					w.Code, loc, w.Body.String())
+			}
+
+			// And that's really where the result is.
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", loc, nil)
+			serve(api, w, r)
+			if w.Code != 200 || !strings.Contains(w.Body.String(), "ZEHhW") {
+				t.Errorf("Location doesn't have the result: status=%d body=%#q",
+					w.Code, w.Body.String())
+			}
+		})
+		t.Run("stretches the hash with iterations", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			for _, body := range []string{
+				"password=angryMonkey&algo=md5",
+				"password=angryMonkey&algo=md5&iterations=5",
+			} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", strings.NewReader(body))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				if w.Code != 202 {
+					t.Fatalf("Wrong output for %s: status=%d body=%#q", body, w.Code, w.Body.String())
+				}
+			}
+			expected, _ := HashTask{Password: "angryMonkey", Algo: "md5", Iterations: 5}.Run()
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/2?verbose=true", nil)
+			serve(api, w, r)
+			var resp struct {
+				Result     string `json:"result"`
+				Iterations int    `json:"iterations"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Result != expected || resp.Result == "9R7T/2LRbbkJrnNRIuP9Ag==" || resp.Iterations != 5 {
+				t.Errorf("Wrong output: %s", w.Body.String())
+			}
+
+			// Streamed inputs are stretched too.
+			w, r = httptest.NewRecorder(), httptest.NewRequest("POST", "/hash?algo=md5&iterations=5", strings.NewReader("angryMonkey"))
+			r.Header.Set("Content-Type", "application/octet-stream")
+			serve(api, w, r)
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/3", nil)
+			serve(api, w, r)
+			if w.Body.String() != `"`+expected.(string)+`"`+"\n" {
+				t.Errorf("Wrong streamed output: %s", w.Body.String())
+			}
+		})
+		t.Run("rejects bad iterations", func(t *testing.T) {
+			api := &HashApi{MaxIterations: 100}
+			for _, iterations := range []string{"0", "-1", "two", "101"} {
+				input := strings.NewReader("password=angryMonkey&iterations=" + iterations)
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				if code, _ := jsonError(t, w); w.Code != http.StatusBadRequest || code != "invalid_iterations" {
+					t.Errorf("Wrong output for %s: status=%d body=%#q", iterations, w.Code, w.Body.String())
+				}
+			}
+			if list := api.Tasks.List(); len(list) != 0 {
+				t.Errorf("Started tasks: %v", list)
+			}
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey&iterations=100"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+			if w.Code != 202 {
+				t.Errorf("Rejected the maximum: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("uses the configured id prefix", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.IdPrefix = "hash-"
+			input := strings.NewReader("password=angryMonkey")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+			loc := w.Header().Get("Location")
+			if w.Code != 202 || loc != "/hash/hash-1" || w.Body.String() != "hash-1" {
+				t.Fatalf("Wrong output: status=%d location=%#q body=%#q",
+					w.Code, loc, w.Body.String())
+			}
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", loc, nil)
+			serve(api, w, r)
+			if w.Code != 200 || !strings.Contains(w.Body.String(), "ZEHhW") {
+				t.Errorf("Wrong result: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("uses the configured delay", func(t *testing.T) {
+			for _, test := range []struct{ configured, expected time.Duration }{
+				{0, DefaultDelay},
+				{time.Second, time.Second},
+				{-1, 0},
+			} {
+				api := withSequentialIds(&HashApi{Delay: test.configured})
+				input := strings.NewReader("password=foobar")
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				info, err := api.Tasks.Info("1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if delay := info.Task.(HashTask).Delay; delay != test.expected {
+					t.Errorf("Configured %v, expected a delay of %v but got %v",
+						test.configured, test.expected, delay)
+				}
+			}
+		})
 		t.Run("fails if password form field is not provided", func(t *testing.T) {
 			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", nil)
 			(&HashApi{}).Start(w, r)
 			if w.Code != http.StatusBadRequest {
 				t.Fatal("Did not fail for a missing password param")
 			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Wrong content type: %s", ct)
+			}
+			if code, msg := jsonError(t, w); code != "missing_field" || msg != "Missing password form field" {
+				t.Errorf("Wrong error: code=%q msg=%q", code, msg)
+			}
+		})
+		t.Run("ignores password in the url query", func(t *testing.T) {
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash?password=foobar", nil)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			(&HashApi{}).Start(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Accepted a password from the url: status=%d body=%s", w.Code, w.Body.String())
+			}
+		})
+		t.Run("hashes a different field if requested", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			input := strings.NewReader("field=username&username=angryMonkey&password=foobar")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+			if w.Code != 202 {
+				t.Fatalf("Wrong output: status=%d body=%s", w.Code, w.Body.String())
+			}
+			const expected = `ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q==`
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v", res, err)
+			}
+		})
+		t.Run("fails if the requested field is not provided", func(t *testing.T) {
+			input := strings.NewReader("field=username&password=foobar")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			(&HashApi{}).Start(w, r)
+			if _, msg := jsonError(t, w); w.Code != http.StatusBadRequest || msg != "Missing username form field" {
+				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("uses the algorithm from the form", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			input := strings.NewReader("password=angryMonkey&algo=sha256")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+
+			const expected = `/iKaK4dQuFt0w2h6u20dpZQ7EPaM30pdx/sWN4BXIR8=`
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v", res, err)
+			}
+		})
+		t.Run("accepts a JSON body", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			input := strings.NewReader(`{"password": "angryMonkey", "algo": "sha256"}`)
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/json; charset=utf-8")
+			serve(api, w, r)
+			if w.Code != 202 || w.Body.String() != "1" {
+				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+
+			const expected = `/iKaK4dQuFt0w2h6u20dpZQ7EPaM30pdx/sWN4BXIR8=`
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v", res, err)
+			}
+		})
+		t.Run("accepts JSON numbers for numeric values", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			input := strings.NewReader(`{"password": "angryMonkey", "algo": "md5", "iterations": 3}`)
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/json")
+			serve(api, w, r)
+			if w.Code != 202 || w.Body.String() != "1" {
+				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+
+			expected, _ := HashTask{Password: "angryMonkey", Algo: "md5", Iterations: 3}.Run()
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v, expected %#v", res, err, expected)
+			}
+		})
+		t.Run("rejects malformed JSON", func(t *testing.T) {
+			for _, body := range []string{
+				`{"password": "angryMonkey"`,
+				`["angryMonkey"]`,
+				`{"password": ["angryMonkey"]}`,
+				`{"password": {"value": "angryMonkey"}}`,
+			} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", strings.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				(&HashApi{}).Start(w, r)
+				if code, _ := jsonError(t, w); w.Code != http.StatusBadRequest || code != "invalid_json" {
+					t.Errorf("Wrong output for %#q: status=%d body=%#q", body, w.Code, w.Body.String())
+				}
+			}
+		})
+		t.Run("uses the encoding from the form", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			input := strings.NewReader("password=angryMonkey&algo=sha256&encoding=hex")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			const expected = "fe229a2b8750b85b74c3687abb6d1da5943b10f68cdf4a5dc7fb16378057211f"
+			if w.Code != 200 || w.Body.String() != `"`+expected+`"`+"\n" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+
+			input = strings.NewReader("password=angryMonkey&encoding=base32")
+			w, r = httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Accepted an unknown encoding: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("hashes uploaded files", func(t *testing.T) {
+			upload := func(api *HashApi, contents string) *httptest.ResponseRecorder {
+				var body bytes.Buffer
+				form := multipart.NewWriter(&body)
+				form.WriteField("algo", "sha256")
+				file, _ := form.CreateFormFile("file", "monkey.txt")
+				io.WriteString(file, contents)
+				form.Close()
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", &body)
+				r.Header.Set("Content-Type", form.FormDataContentType())
+				serve(api, w, r)
+				return w
+			}
+
+			api := withSequentialIds(&HashApi{MaxFileSize: 16})
+			if w := upload(api, "angryMonkey"); w.Code != 202 || w.Body.String() != "1" {
+				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			const expected = `/iKaK4dQuFt0w2h6u20dpZQ7EPaM30pdx/sWN4BXIR8=`
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v", res, err)
+			}
+
+			if w := upload(api, "a much angrier monkey"); w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Accepted a file that's too large: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("streams raw bodies", func(t *testing.T) {
+			stream := func(api *HashApi, url string, body []byte) *httptest.ResponseRecorder {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", url, bytes.NewReader(body))
+				r.Header.Set("Content-Type", "application/octet-stream")
+				serve(api, w, r)
+				return w
+			}
+
+			api := withSequentialIds(&HashApi{MaxFileSize: 8 << 20})
+			blob := bytes.Repeat([]byte("angryMonkey"), 5<<20/11) // ~5 MB
+			if w := stream(api, "/hash?algo=sha256&encoding=hex", blob); w.Code != 202 || w.Body.String() != "1" {
+				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			sum := sha256.Sum256(blob)
+			expected := hex.EncodeToString(sum[:])
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v", res, err)
+			}
+			if n := api.BytesHashed(); n != int64(len(blob)) {
+				t.Errorf("Wrong number of bytes hashed: %d, expected %d", n, len(blob))
+			}
+
+			api.MaxFileSize = 1 << 20
+			if w := stream(api, "/hash", blob); w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Accepted a body that's too large: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			if w := stream(api, "/hash?algo=nope", []byte("angryMonkey")); w.Code != 400 {
+				t.Errorf("Accepted an unknown algorithm: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("computes HMACs with the configured key", func(t *testing.T) {
+			start := func(api *HashApi) *httptest.ResponseRecorder {
+				input := strings.NewReader("password=angryMonkey&algo=hmac-sha512")
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				return w
+			}
+
+			api := withSequentialIds(&HashApi{HMACKey: []byte("secret")})
+			if w := start(api); w.Code != 202 || w.Body.String() != "1" {
+				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			const expected = "qzITTA1fk6QbuCV/0jPvBodemDRSNCVVYFjQz2vHoMrHrsBtkQGrkTQuAmGHz4smmCm+OvuujzpKuQa/k1g5tg=="
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v", res, err)
+			}
+
+			// The key isn't configured, which is the server's fault.
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+			if w := start(withSequentialIds(&HashApi{})); w.Code != 500 {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			if !strings.Contains(logs.String(), "no HMAC key is configured") {
+				t.Errorf("Didn't log why HMAC failed: %q", logs.String())
+			}
+		})
+		t.Run("reports the salt with the result", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			input := strings.NewReader("password=angryMonkey&salt=pepper")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			expected, _ := HashTask{Password: "6:pepperangryMonkey"}.Run()
+			if body := fmt.Sprintf(`{"hash":%q,"salt":"pepper"}`+"\n", expected); w.Body.String() != body {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("uses the configured default algorithm", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{DefaultAlgo: "sha512-tree"})
+			input := strings.NewReader("password=angryMonkey")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+
+			expected, _ := HashTask{Password: "angryMonkey", Algo: "sha512-tree"}.Run()
+			if res, err := api.Tasks.Wait(context.Background(), "1"); err != nil || res != expected {
+				t.Errorf("Wrong result: res=%#v err=%v", res, err)
+			}
+		})
+		t.Run("rejects weak passwords", func(t *testing.T) {
+			api := &HashApi{WeakPasswords: &PasswordList{}}
+			api.WeakPasswords.passwords = map[string]struct{}{"123456": {}}
+			for password, expected := range map[string]int{
+				"123456":    http.StatusUnprocessableEntity,
+				"x8#kLq!2z": http.StatusAccepted,
+			} {
+				input := strings.NewReader("password=" + url.QueryEscape(password))
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				if w.Code != expected {
+					t.Errorf("Wrong status for %q: %d %s", password, w.Code, w.Body.String())
+				}
+			}
+		})
+		t.Run("enforces the length limits", func(t *testing.T) {
+			api := &HashApi{MinLength: 4, MaxLength: 8}
+			for _, test := range []struct {
+				password string
+				expected int
+				message  string
+			}{
+				{"abc", http.StatusBadRequest, "The password field is too short: it must be at least 4 bytes."},
+				{"abcd", http.StatusAccepted, ""},
+				{"abcdefgh", http.StatusAccepted, ""},
+				{"abcdefghi", http.StatusBadRequest, "The password field is too long: it must be at most 8 bytes."},
+			} {
+				input := strings.NewReader("password=" + test.password)
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				if w.Code != test.expected {
+					t.Errorf("Wrong status for %q: %d %s", test.password, w.Code, w.Body.String())
+				} else if test.message != "" {
+					if _, msg := jsonError(t, w); msg != test.message {
+						t.Errorf("Wrong message for %q: %#q", test.password, w.Body.String())
+					}
+				}
+			}
+		})
+		t.Run("fails for an unknown algorithm", func(t *testing.T) {
+			input := strings.NewReader("password=foobar&algo=rot13")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			(&HashApi{}).Start(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Accepted an unknown algorithm: status=%d body=%s", w.Code, w.Body.String())
+			}
+		})
+		t.Run("limits the bytes hashed per window", func(t *testing.T) {
+			defer func() { time_Now = time.Now }()
+			now := time.Now()
+			time_Now = func() time.Time { return now }
+
+			api := &HashApi{MaxBytesPerWindow: 10, ByteWindow: time.Minute}
+			start := func(password string) int {
+				input := strings.NewReader("password=" + password)
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				return w.Code
+			}
+
+			if code := start("123456"); code != 202 {
+				t.Errorf("Wrong status for first request: %d", code)
+			}
+			if code := start("123456"); code != http.StatusTooManyRequests {
+				t.Errorf("Wrong status when over budget: %d", code)
+			}
+			if code := start("1234"); code != 202 {
+				t.Errorf("Wrong status for request that fits the budget: %d", code)
+			}
+			now = now.Add(time.Minute)
+			if code := start("123456"); code != 202 {
+				t.Errorf("Wrong status after the window rolled over: %d", code)
+			}
+			if n := api.BytesHashed(); n != 16 {
+				t.Errorf("Wrong number of bytes hashed: %d", n)
+			}
+		})
+		t.Run("shares the byte budget between HashApis", func(t *testing.T) {
+			bytes := &ByteBudget{}
+			a := &HashApi{MaxBytesPerWindow: 10, Bytes: bytes}
+			b := &HashApi{MaxBytesPerWindow: 10, Bytes: bytes}
+			start := func(api *HashApi, password string) int {
+				input := strings.NewReader("password=" + password)
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				return w.Code
+			}
+
+			if code := start(a, "123456"); code != 202 {
+				t.Errorf("Wrong status for first request: %d", code)
+			}
+			if code := start(b, "123456"); code != http.StatusTooManyRequests {
+				t.Errorf("Wrong status when over the shared budget: %d", code)
+			}
+			if code := start(b, "1234"); code != 202 {
+				t.Errorf("Wrong status for request that fits the budget: %d", code)
+			}
+			if na, nb := a.BytesHashed(), b.BytesHashed(); na != 10 || nb != 10 {
+				t.Errorf("Wrong number of bytes hashed: %d and %d", na, nb)
+			}
+		})
+		t.Run("fails if any of several algorithms is unknown", func(t *testing.T) {
+			input := strings.NewReader("password=foobar&algo=crc32,rot13")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			(&HashApi{}).Start(w, r)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "rot13") {
+				t.Fatalf("Wrong output: status=%d body=%s", w.Code, w.Body.String())
+			}
+		})
+		t.Run("fails when too many hashes are queued", func(t *testing.T) {
+			api := &HashApi{}
+			api.Tasks.MaxConcurrent, api.Tasks.MaxQueued = 1, 1
+			block := blockingTask(make(chan struct{}))
+			defer close(block)
+			api.Tasks.Start(block)
+			api.Tasks.Start(block)
+
+			input := strings.NewReader("password=foobar")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+				t.Fatalf("Did not fail with a full queue: status=%d body=%s", w.Code, w.Body.String())
+			}
 		})
 		t.Run("fails when shutting down", func(t *testing.T) {
 			input := strings.NewReader("password=foobar")
@@ -75,19 +837,64 @@ func TestHashApi(t *testing.T) {
 			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			api := &HashApi{}
 			api.Tasks.Shutdown(context.Background())
-			api.Start(w, r)
+			serve(api, w, r)
 			if w.Code != http.StatusServiceUnavailable {
 				t.Fatalf("Did not fail after shutdown: status=%d body=%s", w.Code, w.Body.String())
 			}
 		})
 	})
 
+	t.Run("Batch", func(t *testing.T) {
+		t.Run("starts a task for each password", func(t *testing.T) {
+			api := &HashApi{}
+			input := strings.NewReader(`["angryMonkey", "foobar", "angryMonkey"]`)
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash/batch", input)
+			serve(api, w, r)
+			if w.Code != 202 {
+				t.Fatalf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			var ids []task.Id
+			if err := json.Unmarshal(w.Body.Bytes(), &ids); err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != 3 || ids[0] == ids[1] || ids[1] == ids[2] || ids[0] == ids[2] {
+				t.Fatalf("Expected 3 distinct ids: %q", ids)
+			}
+			for i, password := range []string{"angryMonkey", "foobar", "angryMonkey"} {
+				expected, _ := HashTask{Password: password}.Run()
+				if res, err := api.Tasks.Wait(context.Background(), ids[i]); err != nil || res != expected {
+					t.Errorf("Wrong result for %s: res=%#v err=%v", ids[i], res, err)
+				}
+			}
+		})
+		t.Run("rejects bad batches", func(t *testing.T) {
+			api := &HashApi{MaxBatchSize: 2, MinLength: 4}
+			for _, test := range []struct {
+				body, message string
+			}{
+				{`{"password": "foobar"}`, "Invalid JSON request: "},
+				{`[]`, "A batch must have between 1 and 2 passwords, not 0."},
+				{`["a1b2", "c3d4", "e5f6"]`, "A batch must have between 1 and 2 passwords, not 3."},
+				{`["a1b2", ""]`, "Password 2 in the batch is empty"},
+				{`["abc"]`, "Password 1 in the batch is too short: it must be at least 4 bytes."},
+			} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash/batch", strings.NewReader(test.body))
+				serve(api, w, r)
+				if _, msg := jsonError(t, w); w.Code != http.StatusBadRequest || !strings.HasPrefix(msg, test.message) {
+					t.Errorf("Wrong output for %#q: status=%d body=%#q", test.body, w.Code, w.Body.String())
+				}
+			}
+			if list := api.Tasks.List(); len(list) != 0 {
+				t.Errorf("Started tasks for rejected batches: %v", list)
+			}
+		})
+	})
 	t.Run("GetResult", func(t *testing.T) {
 		t.Run("returns the hash of the input", func(t *testing.T) {
-			api := &HashApi{}
-			api.Tasks.Start(HashTask("angryMonkey"))
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.Start(HashTask{Password: "angryMonkey"})
 			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
-			api.GetResult(w, r)
+			serve(api, w, r)
 			const expected = `"ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="`
 			if w.Code != 200 || w.Body.String() != expected+"\n" {
 				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
@@ -96,6 +903,869 @@ func TestHashApi(t *testing.T) {
 				t.Errorf("Wrong content type: %s", ct)
 			}
 		})
+		t.Run("negotiates the content type", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{DefaultAlgo: "md5"})
+			api.Tasks.Start(HashTask{Password: "angryMonkey", Algo: "md5"})
+			for _, test := range []struct {
+				accept, contentType, body string
+			}{
+				{"", "application/json", `"9R7T/2LRbbkJrnNRIuP9Ag=="` + "\n"},
+				{"*/*", "application/json", `"9R7T/2LRbbkJrnNRIuP9Ag=="` + "\n"},
+				{"application/json", "application/json", `"9R7T/2LRbbkJrnNRIuP9Ag=="` + "\n"},
+				{"text/plain", "text/plain; charset=utf-8", "9R7T/2LRbbkJrnNRIuP9Ag==\n"},
+				{"text/*", "text/plain; charset=utf-8", "9R7T/2LRbbkJrnNRIuP9Ag==\n"},
+				{"text/html, text/plain;q=0.9, */*;q=0.1", "text/plain; charset=utf-8", "9R7T/2LRbbkJrnNRIuP9Ag==\n"},
+				{"text/plain;q=0.5, application/json", "application/json", `"9R7T/2LRbbkJrnNRIuP9Ag=="` + "\n"},
+				{"text/plain, application/json", "application/json", `"9R7T/2LRbbkJrnNRIuP9Ag=="` + "\n"},
+			} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+				r.Header.Set("Accept", test.accept)
+				serve(api, w, r)
+				if w.Code != 200 || w.Body.String() != test.body {
+					t.Errorf("Wrong output for %q: status=%d body=%#q", test.accept, w.Code, w.Body.String())
+				}
+				if ct := w.Header().Get("Content-Type"); ct != test.contentType {
+					t.Errorf("Wrong content type for %q: %s", test.accept, ct)
+				}
+			}
+		})
+		t.Run("rejects unacceptable content types", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			block := blockingTask(make(chan struct{}))
+			defer close(block)
+			api.Tasks.Start(block)
+			for _, accept := range []string{"text/html", "image/*", "application/json;q=0, text/plain;q=0"} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+				r.Header.Set("Accept", accept)
+				serve(api, w, r) // Doesn't wait for the task.
+				if w.Code != http.StatusNotAcceptable {
+					t.Errorf("Wrong status for %q: %d", accept, w.Code)
+				}
+				if code, _ := jsonError(t, w); code != "not_acceptable" {
+					t.Errorf("Wrong error code for %q: %q", accept, code)
+				}
+			}
+		})
+		t.Run("serves only the hash of salted results as text", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.Start(HashTask{Password: "angryMonkey", Salt: "pepper", Algo: "md5"})
+			api.Tasks.Start(HashTask{Password: "angryMonkey", Salt: "pepper", Algo: "md5,sha1"})
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			var salted struct{ Hash, Salt string }
+			if err := json.Unmarshal(w.Body.Bytes(), &salted); err != nil || salted.Salt != "pepper" {
+				t.Fatalf("Wrong JSON output: %v %#q", err, w.Body.String())
+			}
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			r.Header.Set("Accept", "text/plain")
+			serve(api, w, r)
+			if w.Code != 200 || w.Body.String() != salted.Hash+"\n" {
+				t.Errorf("Wrong text output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+
+			// Several hashes have no plain text form.
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/2", nil)
+			r.Header.Set("Accept", "text/plain")
+			serve(api, w, r)
+			if code, _ := jsonError(t, w); w.Code != http.StatusNotAcceptable || code != "not_acceptable" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("reports missing tasks as JSON", func(t *testing.T) {
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/nope", nil)
+			serve(&HashApi{}, w, r)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Wrong status: %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Wrong content type: %s", ct)
+			}
+			if code, msg := jsonError(t, w); code != "no_such_task" || msg != "No such task" {
+				t.Errorf("Wrong error: code=%q msg=%q", code, msg)
+			}
+		})
+		t.Run("reports results that can't be encoded", func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			api := withSequentialIds(&HashApi{ResultStatus: http.StatusOK})
+			api.Tasks.Start(chanTask{})
+			for _, path := range []string{"/hash/1", "/hash/1?verbose=true"} {
+				logs.Reset()
+				w, r := httptest.NewRecorder(), httptest.NewRequest("GET", path, nil)
+				serve(api, w, r)
+				if code, _ := jsonError(t, w); w.Code != http.StatusInternalServerError || code != "internal" {
+					t.Errorf("Wrong output for %s: status=%d body=%#q", path, w.Code, w.Body.String())
+				}
+				if !strings.Contains(logs.String(), "Cannot encode the result of task `1`") {
+					t.Errorf("Didn't log the failure for %s: %s", path, logs.String())
+				}
+			}
+		})
+		t.Run("reports how the hash was computed if verbose", func(t *testing.T) {
+			// Sleep for real, but not for the whole delay.
+			time_NewTimer = func(dt time.Duration) *time.Timer { return time.NewTimer(dt / 100) }
+			defer func() { time_NewTimer = noDelay }()
+
+			api := withSequentialIds(&HashApi{Delay: 5 * time.Second, DefaultAlgo: "md5"})
+			input := strings.NewReader("password=angryMonkey")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", input)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1?verbose=true", nil)
+			serve(api, w, r)
+			var resp struct {
+				Result     string `json:"result"`
+				DurationMs *int64 `json:"duration_ms"`
+				Algo       string `json:"algo"`
+				Iterations int    `json:"iterations"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Bad response (%v): %s", err, w.Body.String())
+			}
+			if resp.Result != "9R7T/2LRbbkJrnNRIuP9Ag==" || resp.Algo != "md5" || resp.Iterations != 1 {
+				t.Errorf("Wrong output: %s", w.Body.String())
+			}
+			if resp.DurationMs == nil || *resp.DurationMs < 50 || *resp.DurationMs > 1000 {
+				t.Errorf("Wrong duration, expected ~50ms: %s", w.Body.String())
+			}
+
+			// Without it, it's still just the hash.
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Body.String() != `"9R7T/2LRbbkJrnNRIuP9Ag=="`+"\n" {
+				t.Errorf("Wrong output: %s", w.Body.String())
+			}
+		})
+		t.Run("estimates when a pending task will be done", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{PendingStatus: http.StatusAccepted})
+			block := blockingTask(make(chan struct{}))
+			defer close(block)
+			api.Tasks.Start(estimatedTask{block, 10 * time.Second})
+
+			// Wait until it's running so that the estimate is deterministic.
+			for info, _ := api.Tasks.Info("1"); info.Status != task.Running; info, _ = api.Tasks.Info("1") {
+				time.Sleep(time.Millisecond)
+			}
+			info, _ := api.Tasks.Info("1")
+			defer func() { time_Now = time.Now }()
+			time_Now = func() time.Time { return info.Started.Add(2500 * time.Millisecond) }
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Code != 202 || w.Body.String() != `{"status":"processing","eta_ms":7500}`+"\n" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			if ra := w.Header().Get("Retry-After"); ra != "8" {
+				t.Errorf("Wrong Retry-After: %#q", ra)
+			}
+		})
+		t.Run("doesn't block with wait=false", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{PollTimeout: 20 * time.Millisecond})
+			block := blockingTask(make(chan struct{}))
+			api.Tasks.Start(block)
+
+			start := time.Now()
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1?wait=false", nil)
+			serve(api, w, r)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Blocked for %v", elapsed)
+			}
+			if w.Code != http.StatusAccepted || w.Body.String() != `{"status":"processing"}`+"\n" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+
+			// Finishing within the timeout gives the result right away.
+			time.AfterFunc(10*time.Millisecond, func() { close(block) })
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1?wait=false", nil)
+			api.PollTimeout = time.Minute
+			serve(api, w, r)
+			if w.Code != 200 || w.Body.String() != `"finished"`+"\n" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("honors X-Max-Wait-Ms", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{MaxWait: time.Minute})
+			block := blockingTask(make(chan struct{}))
+			defer close(block)
+			api.Tasks.Start(block)
+
+			for _, test := range []struct {
+				header  string
+				maxWait time.Duration
+			}{
+				{"0", time.Minute},
+				{"10", time.Minute},
+				// Invalid values fall back to MaxWait.
+				{"-5", 10 * time.Millisecond},
+				{"bogus", 10 * time.Millisecond},
+				{"", 10 * time.Millisecond},
+			} {
+				header := test.header
+				api.MaxWait = test.maxWait
+				start := time.Now()
+				w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+				r.Header.Set("X-Max-Wait-Ms", header)
+				serve(api, w, r)
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("Blocked for %v with %#q", elapsed, header)
+				}
+				if w.Code != http.StatusAccepted {
+					t.Errorf("Wrong status for %#q: %d %s", header, w.Code, w.Body.String())
+				}
+			}
+
+			// MaxWait caps what clients ask for.
+			api.MaxWait = 10 * time.Millisecond
+			start := time.Now()
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			r.Header.Set("X-Max-Wait-Ms", "60000")
+			serve(api, w, r)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("X-Max-Wait-Ms wasn't capped: blocked for %v", elapsed)
+			}
+			// Even when it's too big for a time.Duration.
+			start = time.Now()
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			r.Header.Set("X-Max-Wait-Ms", "9223372036854775807")
+			serve(api, w, r)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Huge X-Max-Wait-Ms wasn't capped: blocked for %v", elapsed)
+			}
+
+			// Without MaxWait, there's still a limit.
+			r = httptest.NewRequest("GET", "/hash/1", nil)
+			r.Header.Set("X-Max-Wait-Ms", "86400000")
+			ctx, cancel := (&HashApi{}).waitContext(r)
+			defer cancel()
+			if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > DefaultMaxRequestedWait {
+				t.Errorf("X-Max-Wait-Ms wasn't capped by default: %v %v", deadline, ok)
+			}
+		})
+		t.Run("doesn't let X-Max-Wait-Ms lengthen polls", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{
+				PendingStatus: http.StatusTooEarly,
+				PollTimeout:   10 * time.Millisecond,
+			})
+			block := blockingTask(make(chan struct{}))
+			defer close(block)
+			api.Tasks.Start(block)
+
+			start := time.Now()
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			r.Header.Set("X-Max-Wait-Ms", "60000")
+			serve(api, w, r)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Blocked for %v", elapsed)
+			}
+			if w.Code != http.StatusTooEarly {
+				t.Errorf("Wrong status: %d %s", w.Code, w.Body.String())
+			}
+		})
+		t.Run("uses the configured status code", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{ResultStatus: http.StatusNonAuthoritativeInfo})
+			api.Tasks.Start(HashTask{Password: "angryMonkey"})
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Code != http.StatusNonAuthoritativeInfo {
+				t.Errorf("Wrong status: %d", w.Code)
+			}
+		})
+		t.Run("supports range requests for byte results", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.Start(bytesTask("0123456789"))
+			api.Tasks.Start(readerTask("0123456789"))
+
+			for _, id := range []string{"1", "2"} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/"+id, nil)
+				serve(api, w, r)
+				if w.Code != 200 || w.Body.String() != "0123456789" {
+					t.Errorf("[%s] Wrong output: status=%d body=%#q", id, w.Code, w.Body.String())
+				}
+
+				w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/"+id, nil)
+				r.Header.Set("Range", "bytes=2-4")
+				serve(api, w, r)
+				if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+					t.Errorf("[%s] Wrong output: status=%d body=%#q", id, w.Code, w.Body.String())
+				}
+				if cr := w.Header().Get("Content-Range"); cr != "bytes 2-4/10" {
+					t.Errorf("[%s] Wrong Content-Range: %#q", id, cr)
+				}
+
+				w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/"+id, nil)
+				r.Header.Set("Range", "bytes=20-30")
+				serve(api, w, r)
+				if w.Code != http.StatusRequestedRangeNotSatisfiable {
+					t.Errorf("[%s] Wrong status for invalid range: %d", id, w.Code)
+				}
+			}
+		})
+		t.Run("includes error messages if VerboseErrors is set", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{VerboseErrors: true})
+			api.Tasks.Start(failingTask{errors.New("internal details")})
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			const expected = `{"id":"1","status":"failed","error":{"code":"internal","message":"internal details"}}` + "\n"
+			if w.Code != 500 || w.Body.String() != expected {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("responds with no content for a nil result", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.Start(failingTask{nil}) // i.e. returns (nil, nil)
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("reports task failures as structured errors", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.Start(failingTask{errors.New("secret internal details")})
+			api.Tasks.Start(failingTask{fmt.Errorf("wrapped: %w", quotaError{})})
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			const generic = `{"id":"1","status":"failed","error":{"code":"internal"}}` + "\n"
+			if w.Code != 500 || w.Body.String() != generic {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Wrong content type: %s", ct)
+			}
+
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/2", nil)
+			serve(api, w, r)
+			const custom = `{"id":"2","status":"failed","error":{"code":"quota"}}` + "\n"
+			if w.Code != http.StatusPaymentRequired || w.Body.String() != custom {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("reports timed out tasks as failed", func(t *testing.T) {
+			time_NewTimer = time.NewTimer // the hash has to still be running
+			defer func() { time_NewTimer = noDelay }()
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.StartWithTimeout(HashTask{Password: "angryMonkey", Delay: time.Hour}, time.Millisecond)
+			api.Tasks.Wait(context.Background(), "1")
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			const expected = `{"id":"1","status":"failed","error":{"code":"timeout"}}` + "\n"
+			if w.Code != http.StatusGatewayTimeout || w.Body.String() != expected {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("sheds load beyond MaxInFlight", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{MaxInFlight: 2})
+			block := blockingTask(make(chan struct{}))
+			api.Tasks.Start(block)
+			api.Tasks.Start(block)
+
+			for _, req := range []struct{ path, body string }{
+				{"/hash", "password=angryMonkey"},
+				{"/hash/batch", `["angryMonkey"]`},
+			} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("POST", req.path, strings.NewReader(req.body))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				serve(api, w, r)
+				if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+					t.Errorf("Wrong status for %s when saturated: %d %v", req.path, w.Code, w.Header())
+				}
+				if code, _ := jsonError(t, w); code != "overloaded" {
+					t.Errorf("Wrong error code for %s: %q", req.path, code)
+				}
+			}
+			if n := api.Tasks.InFlight(); n != 2 {
+				t.Errorf("Started tasks anyway: %d in flight", n)
+			}
+
+			// Once they're done, there's room again.
+			close(block)
+			api.Tasks.Wait(context.Background(), "1")
+			api.Tasks.Wait(context.Background(), "2")
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", strings.NewReader("password=angryMonkey"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			serve(api, w, r)
+			if w.Code != http.StatusAccepted {
+				t.Errorf("Wrong status after draining: %d %s", w.Code, w.Body.String())
+			}
+		})
+		t.Run("sheds load beyond MaxWaiting", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{MaxWaiting: 2})
+			task := blockingTask(make(chan struct{}))
+			api.Tasks.Start(task)
+
+			codes := make(chan int)
+			for i := 0; i < 2; i++ {
+				go func() {
+					w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+					serve(api, w, r)
+					codes <- w.Code
+				}()
+			}
+			for start := time.Now(); api.waiting.Load() < 2; time.Sleep(time.Millisecond) {
+				if time.Since(start) > time.Second {
+					t.Fatalf("Waiters never started waiting: %d", api.waiting.Load())
+				}
+			}
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("Wrong status when saturated: %d", w.Code)
+			}
+
+			close(task)
+			for i := 0; i < 2; i++ {
+				if code := <-codes; code != 200 {
+					t.Errorf("Wrong status for waiter: %d", code)
+				}
+			}
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Code != 200 {
+				t.Errorf("Wrong status after waiters finished: %d", w.Code)
+			}
+		})
+		t.Run("can respond immediately while pending", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{PendingStatus: http.StatusTooEarly})
+			task := blockingTask(make(chan struct{}))
+			api.Tasks.Start(task)
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Code != http.StatusTooEarly || w.Body.String() != `{"status":"processing"}`+"\n" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			if ra := w.Header().Get("Retry-After"); ra != "1" {
+				t.Errorf("Wrong Retry-After: %#q", ra)
+			}
+
+			close(task)
+			api.Tasks.Shutdown(context.Background()) // wait for it to finish
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			if w.Code != 200 || w.Body.String() != `"finished"`+"\n" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
 		// ... etc etc ...
 	})
+	t.Run("WaitMany", func(t *testing.T) {
+		t.Run("reports done, failed, pending and missing tasks", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			block := blockingTask(make(chan struct{}))
+			defer close(block)
+			api.Tasks.Start(HashTask{Password: "angryMonkey", Algo: "md5"})
+			api.Tasks.Start(failingTask{quotaError{}})
+			api.Tasks.Start(block)
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/batch?ids=1,2,3,nope,1", nil)
+			r.Header.Set("X-Max-Wait-Ms", "50")
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			serve(api, w, r)
+			const expected = `{"1":{"status":"done","result":"9R7T/2LRbbkJrnNRIuP9Ag=="},` +
+				`"2":{"status":"failed","error":{"code":"quota"}},` +
+				`"3":{"status":"pending"},` +
+				`"nope":{"status":"not_found"}}` + "\n"
+			if w.Code != 200 || w.Body.String() != expected {
+				t.Errorf("Wrong output: status=%d body=%s", w.Code, w.Body.String())
+			}
+		})
+		t.Run("reports cancelled and timed out tasks as failed", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			api.Tasks.Start(failingTask{context.Canceled})
+			api.Tasks.Start(failingTask{context.DeadlineExceeded})
+
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/batch?ids=1,2", nil)
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			serve(api, w, r)
+			const expected = `{"1":{"status":"failed","error":{"code":"cancelled"}},` +
+				`"2":{"status":"failed","error":{"code":"timeout"}}}` + "\n"
+			if w.Code != 200 || w.Body.String() != expected {
+				t.Errorf("Wrong output: status=%d body=%s", w.Code, w.Body.String())
+			}
+		})
+		t.Run("waits for all of them", func(t *testing.T) {
+			api := withSequentialIds(&HashApi{})
+			first, second := blockingTask(make(chan struct{})), blockingTask(make(chan struct{}))
+			api.Tasks.Start(first)
+			api.Tasks.Start(second)
+			go func() {
+				close(first)
+				time.Sleep(10 * time.Millisecond)
+				close(second)
+			}()
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/batch?ids=1,2", nil)
+			serve(api, w, r)
+			var resp map[string]struct{ Status string }
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp["1"].Status != "done" || resp["2"].Status != "done" {
+				t.Errorf("Wrong output: %s", w.Body.String())
+			}
+		})
+		t.Run("rejects bad lists of ids", func(t *testing.T) {
+			api := &HashApi{MaxBatchSize: 2}
+			for _, url := range []string{"/hash/batch", "/hash/batch?ids=", "/hash/batch?ids=1,2,3"} {
+				w, r := httptest.NewRecorder(), httptest.NewRequest("GET", url, nil)
+				serve(api, w, r)
+				if code, _ := jsonError(t, w); w.Code != http.StatusBadRequest || code != "invalid_batch" {
+					t.Errorf("Wrong output for %s: status=%d body=%s", url, w.Code, w.Body.String())
+				}
+			}
+		})
+	})
+	t.Run("Routing", func(t *testing.T) {
+		api := withSequentialIds(&HashApi{Delay: -1})
+		api.Tasks.Start(bytesTask("done"))
+		api.Tasks.Wait(context.Background(), "1")
+
+		for _, test := range []struct {
+			method, path string
+			expected     int
+		}{
+			{"GET", "/hash/1", http.StatusOK},
+			{"POST", "/hash/1", http.StatusMethodNotAllowed},
+			{"PUT", "/hash", http.StatusMethodNotAllowed},
+			{"PUT", "/hash/verify", http.StatusMethodNotAllowed},
+			{"POST", "/healthz", http.StatusMethodNotAllowed},
+			{"GET", "/hash/1/extra", http.StatusNotFound},
+			{"GET", "/nope", http.StatusNotFound},
+		} {
+			w := httptest.NewRecorder()
+			serve(api, w, httptest.NewRequest(test.method, test.path, nil))
+			if w.Code != test.expected {
+				t.Errorf("%s %s: expected %d, got %d %s",
+					test.method, test.path, test.expected, w.Code, w.Body.String())
+			}
+		}
+	})
+	t.Run("wrong methods list the allowed ones", func(t *testing.T) {
+		mux := newMux(&HashApi{}, &EndPointStatsTracker{}, muxConfig{})
+		for _, test := range []struct{ method, path, allow string }{
+			{"PUT", "/hash", "POST"},
+			{"GET", "/hash", "POST"}, // listing is only for dev mode
+			{"POST", "/hash/1", "DELETE, GET, HEAD"},
+			{"DELETE", "/healthz", "GET, HEAD"},
+		} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+			if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != test.allow {
+				t.Errorf("%s %s: wrong response %d Allow=%q, expected Allow=%q",
+					test.method, test.path, w.Code, w.Header().Get("Allow"), test.allow)
+			}
+		}
+	})
+	t.Run("List", func(t *testing.T) {
+		api := withSequentialIds(&HashApi{})
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash", nil)
+		serve(api, w, r)
+		if w.Code != 200 || w.Body.String() != "[]\n" {
+			t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+		}
+
+		api.Tasks.Start(bytesTask("done"))
+		api.Tasks.Wait(context.Background(), "1")
+		block := blockingTask(make(chan struct{}))
+		defer close(block)
+		api.Tasks.Start(block)
+		for info, _ := api.Tasks.Info("2"); info.Status != task.Running; info, _ = api.Tasks.Info("2") {
+			time.Sleep(time.Millisecond)
+		}
+
+		w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash", nil)
+		serve(api, w, r)
+		const expected = `[{"id":"1","status":"done"},{"id":"2","status":"running"}]` + "\n"
+		if w.Code != 200 || w.Body.String() != expected {
+			t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+		}
+	})
+	t.Run("Healthz", func(t *testing.T) {
+		var api HashApi
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil)
+		serve(&api, w, r)
+		if w.Code != 200 || w.Body.String() != `{"status":"ok"}`+"\n" {
+			t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+		}
+
+		block := blockingTask(make(chan struct{}))
+		api.Tasks.Start(block)
+		shutdown := make(chan error)
+		go func() { shutdown <- api.Tasks.Shutdown(context.Background()) }()
+		for !api.Tasks.IsShuttingDown() {
+			time.Sleep(time.Millisecond)
+		}
+
+		// Still draining the running task, but not healthy anymore.
+		w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil)
+		serve(&api, w, r)
+		if w.Code != 503 || w.Body.String() != `{"status":"draining"}`+"\n" {
+			t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+		}
+		close(block)
+		if err := <-shutdown; err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("TaskMetrics", func(t *testing.T) {
+		var api HashApi
+		block := blockingTask(make(chan struct{}))
+		defer close(block)
+		id, _ := api.Tasks.Start(bytesTask("done"))
+		api.Tasks.Wait(context.Background(), id)
+		api.Tasks.Start(block)
+		for api.Tasks.Metrics().Running != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/tasks", nil)
+		serve(&api, w, r)
+		var m task.ManagerMetrics
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || w.Code != 200 {
+			t.Fatalf("Bad response (%v): status=%d body=%#q", err, w.Code, w.Body.String())
+		}
+		if m.Queued != 0 || m.Running != 1 || m.Completed != 1 || m.Failed != 0 {
+			t.Errorf("Wrong counts: %#q", w.Body.String())
+		}
+		for _, field := range []string{`"avg_queue_wait_ns":`, `"avg_run_time_ns":`} {
+			if !strings.Contains(w.Body.String(), field) {
+				t.Errorf("Missing %s: %#q", field, w.Body.String())
+			}
+		}
+	})
+	t.Run("Delete", func(t *testing.T) {
+		api := withSequentialIds(&HashApi{})
+		api.Tasks.Start(bytesTask("done"))
+		api.Tasks.Wait(context.Background(), "1")
+		block := blockingTask(make(chan struct{}))
+		defer close(block)
+		api.Tasks.Start(block)
+
+		for _, test := range []struct {
+			id       string
+			expected int
+		}{
+			{"1", http.StatusNoContent}, // completed
+			{"2", http.StatusNoContent}, // still running
+			{"1", http.StatusNotFound},
+			{"3", http.StatusNotFound},
+		} {
+			w, r := httptest.NewRecorder(), httptest.NewRequest("DELETE", "/hash/"+test.id, nil)
+			serve(api, w, r)
+			if w.Code != test.expected {
+				t.Errorf("Wrong status deleting %s: %d %s", test.id, w.Code, w.Body.String())
+			}
+		}
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/2", nil)
+		serve(api, w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Deleted task is still there: %d %s", w.Code, w.Body.String())
+		}
+	})
+	t.Run("CancelAll", func(t *testing.T) {
+		time_NewTimer = time.NewTimer // the hash has to still be running
+		defer func() { time_NewTimer = noDelay }()
+		api := withSequentialIds(&HashApi{})
+		api.Tasks.Start(HashTask{Password: "angryMonkey", Delay: time.Hour})
+		block := blockingTask(make(chan struct{}))
+		defer close(block)
+		api.Tasks.Start(block)
+		for _, id := range []task.Id{"1", "2"} {
+			for info, _ := api.Tasks.Info(id); info.Status != task.Running; info, _ = api.Tasks.Info(id) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+
+		// It's only served with a token.
+		w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/cancel-all", nil)
+		serve(api, w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Served without a token: %d %s", w.Code, w.Body.String())
+		}
+		mux := newMux(api, &EndPointStatsTracker{}, muxConfig{AdminToken: "s3cret"})
+		w, r = httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/cancel-all", nil)
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Served without auth: %d %s", w.Code, w.Body.String())
+		}
+
+		w, r = httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/cancel-all", nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		mux.ServeHTTP(w, r)
+		if w.Code != 200 || w.Body.String() != `{"cancelled":1,"skipped":1}`+"\n" {
+			t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+		}
+		if _, err := api.Tasks.Wait(context.Background(), "1"); err != context.Canceled {
+			t.Errorf("Hash wasn't cancelled: %v", err)
+		}
+
+		// It's failed for good, so clients mustn't be told to try again.
+		for i := 0; i < 2; i++ {
+			w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+			serve(api, w, r)
+			const expected = `{"id":"1","status":"failed","error":{"code":"cancelled"}}` + "\n"
+			if w.Code != http.StatusServiceUnavailable || w.Body.String() != expected {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		}
+	})
+	t.Run("Sync", func(t *testing.T) {
+		sync := func(api *HashApi, body, accept string) *httptest.ResponseRecorder {
+			w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash/sync", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", accept)
+			serve(api, w, r)
+			return w
+		}
+		t.Run("returns the hash directly", func(t *testing.T) {
+			api := &HashApi{}
+			w := sync(api, "password=angryMonkey", "")
+			const expected = `"ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q=="`
+			if w.Code != 200 || w.Body.String() != expected+"\n" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Wrong content type: %s", ct)
+			}
+			w = sync(api, "password=angryMonkey&algo=md5", "text/plain")
+			if w.Code != 200 || w.Body.String() != "9R7T/2LRbbkJrnNRIuP9Ag==\n" {
+				t.Errorf("Wrong text output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			w = sync(api, "password=angryMonkey&algo=md5&salt=pepper", "")
+			var salted struct{ Hash, Salt string }
+			if err := json.Unmarshal(w.Body.Bytes(), &salted); err != nil || salted.Salt != "pepper" {
+				t.Fatalf("Wrong salted output: %v %#q", err, w.Body.String())
+			}
+			w = sync(api, "password=angryMonkey&algo=md5&salt=pepper", "text/plain")
+			if w.Code != 200 || w.Body.String() != salted.Hash+"\n" {
+				t.Errorf("Wrong salted text output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			if list := api.Tasks.List(); len(list) != 0 {
+				t.Errorf("Started tasks: %v", list)
+			}
+		})
+		t.Run("rejects large inputs", func(t *testing.T) {
+			w := sync(&HashApi{MaxSyncSize: 10}, "password=angryMonkey", "")
+			if code, _ := jsonError(t, w); w.Code != http.StatusRequestEntityTooLarge || code != "too_large" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+			w = sync(&HashApi{}, "password="+strings.Repeat("a", DefaultMaxSyncSize+1), "")
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Wrong status for the default limit: %d", w.Code)
+			}
+		})
+		t.Run("rejects bad requests like Start", func(t *testing.T) {
+			w := sync(&HashApi{}, "password=angryMonkey&algo=rot13", "")
+			if code, _ := jsonError(t, w); w.Code != http.StatusBadRequest || code != "invalid_algo" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("gives up when the client disconnects", func(t *testing.T) {
+			timers := make(chan *time.Timer, 1)
+			time_NewTimer = func(time.Duration) *time.Timer {
+				timer := time.NewTimer(time.Hour)
+				timers <- timer
+				return timer
+			}
+			defer func() { time_NewTimer = noDelay }()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/hash/sync", strings.NewReader("password=angryMonkey")).WithContext(ctx)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+			}()
+			serve(&HashApi{}, w, r)
+			if w.Code != http.StatusRequestTimeout {
+				t.Errorf("Wrong status: %d %s", w.Code, w.Body.String())
+			}
+			// The hash was abandoned along with the request, rather than left
+			// waiting out the delay, so it's safe to restore the stub.
+			select {
+			case timer := <-timers:
+				if timer.Stop() {
+					t.Errorf("The delay is still running")
+				}
+			default:
+				t.Errorf("Never started the delay")
+			}
+		})
+		t.Run("rejects new work while draining", func(t *testing.T) {
+			api := &HashApi{}
+			api.Tasks.Shutdown(context.Background())
+			w := sync(api, "password=angryMonkey", "")
+			if code, _ := jsonError(t, w); w.Code != http.StatusServiceUnavailable || code != "shutting_down" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+		t.Run("counts against MaxWaiting", func(t *testing.T) {
+			api := &HashApi{MaxWaiting: 1}
+			api.waiting.Add(1) // someone's already waiting
+			w := sync(api, "password=angryMonkey", "")
+			if code, _ := jsonError(t, w); w.Code != http.StatusServiceUnavailable || code != "too_many_waiting" {
+				t.Errorf("Wrong output: status=%d body=%#q", w.Code, w.Body.String())
+			}
+		})
+	})
+	t.Run("Verify", func(t *testing.T) {
+		verify := func(api *HashApi, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			api.Verify(w, httptest.NewRequest("POST", "/hash/verify", strings.NewReader(body)))
+			return w
+		}
+		const sha512 = `ZEHhWB65gUlzdVwtDQArEyx+KVLzp/aTaRaPlBzYRIFj6vjFdqEb0Q5B8zVKCZ0vKbZPZklJz0Fd7su2A+gf7Q==`
+		for _, test := range []struct{ body, expected string }{
+			{`{"input":"angryMonkey","expected":"` + sha512 + `"}`, `{"match":true}`},
+			{`{"input":"angryMonkeys","expected":"` + sha512 + `"}`, `{"match":false}`},
+			{`{"input":"angryMonkey","algo":"md5","expected":"9R7T/2LRbbkJrnNRIuP9Ag=="}`, `{"match":true}`},
+			{`{"input":"angryMonkey","algo":"md5","expected":"` + sha512 + `"}`, `{"match":false}`},
+			{`{"input":"Monkey","salt":"angry","algo":"md5","expected":"mne1OwouWltXBPD7NWgS6A=="}`, `{"match":true}`},
+			{`{"input":"Monkey","salt":"angry","expected":"` + sha512 + `"}`, `{"match":false}`},
+			{`{"input":"angryMonkey","algo":"hmac-sha256","expected":"6DeHY171gNaYSlRS13a68ksFRF5A7vfPZzciGSxOorg="}`, `{"match":true}`},
+		} {
+			w := verify(&HashApi{HMACKey: []byte("secret")}, test.body)
+			if w.Code != 200 || w.Body.String() != test.expected+"\n" {
+				t.Errorf("Wrong output for %s: status=%d body=%#q", test.body, w.Code, w.Body.String())
+			}
+		}
+		t.Run("rejects bad requests", func(t *testing.T) {
+			for _, body := range []string{
+				`not json`,
+				`{"expected":"abc"}`,
+				`{"input":"angryMonkey"}`,
+				`{"input":"angryMonkey","algo":"rot13","expected":"abc"}`,
+				`{"input":"angryMonkey","algo":"md5,sha1","expected":"abc"}`,
+			} {
+				if w := verify(&HashApi{}, body); w.Code != http.StatusBadRequest {
+					t.Errorf("Wrong status for %s: %d %s", body, w.Code, w.Body.String())
+				}
+			}
+		})
+		t.Run("counts towards the byte budget", func(t *testing.T) {
+			api := &HashApi{MaxBytesPerWindow: 15}
+			body := `{"input":"angryMonkey","expected":"abc"}`
+			if w := verify(api, body); w.Code != 200 {
+				t.Errorf("Wrong status: %d %s", w.Code, w.Body.String())
+			}
+			if w := verify(api, body); w.Code != http.StatusTooManyRequests {
+				t.Errorf("Wrong status: %d %s", w.Code, w.Body.String())
+			}
+			if n := api.BytesHashed(); n != 11 {
+				t.Errorf("Wrong bytes hashed: %d", n)
+			}
+		})
+	})
 }
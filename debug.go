@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// debugEcho responds with a JSON description of the request it received: the
+// method, path, headers and body length. This is for diagnosing client issues
+// like a wrong Content-Type, which show up as confusing "missing password"
+// errors. It's only for dev mode, but headers that carry credentials are
+// redacted anyway since the output gets pasted into bug reports.
+func debugEcho(w http.ResponseWriter, r *http.Request) {
+	// Read (and count) the body, but don't echo it: it probably contains a
+	// password.
+	bodyLen, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, 10<<20))
+	if err != nil {
+		http.Error(w, "Cannot read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	headers := http.Header{}
+	for name, vals := range r.Header {
+		if isSensitiveHeader(name) {
+			vals = []string{"REDACTED"}
+		}
+		headers[name] = vals
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Method     string      `json:"method"`
+		Path       string      `json:"path"`
+		Headers    http.Header `json:"headers"`
+		BodyLength int64       `json:"body_length"`
+	}{r.Method, r.URL.Path, headers, bodyLen})
+}
+
+func isSensitiveHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization", "Cookie":
+		return true
+	}
+	name = strings.ToLower(name)
+	return strings.Contains(name, "password") || strings.Contains(name, "token")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugEcho(t *testing.T) {
+	r := httptest.NewRequest("POST", "/debug/echo", strings.NewReader("password=hunter2"))
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set("Authorization", "Bearer abc")
+	r.Header.Set("Cookie", "session=xyz")
+	r.Header.Set("X-User-Password", "hunter2")
+	w := httptest.NewRecorder()
+	debugEcho(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("Wrong status: %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "hunter2") ||
+		strings.Contains(w.Body.String(), "abc") ||
+		strings.Contains(w.Body.String(), "xyz") {
+		t.Errorf("Leaked a secret: %s", w.Body.String())
+	}
+
+	var echo struct {
+		Method     string              `json:"method"`
+		Path       string              `json:"path"`
+		Headers    map[string][]string `json:"headers"`
+		BodyLength int                 `json:"body_length"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil {
+		t.Fatal(err)
+	}
+	if echo.Method != "POST" || echo.Path != "/debug/echo" || echo.BodyLength != 16 {
+		t.Errorf("Wrong echo: %+v", echo)
+	}
+	if ct := echo.Headers["Content-Type"]; len(ct) != 1 || ct[0] != "text/plain" {
+		t.Errorf("Wrong content type: %q", ct)
+	}
+	for _, name := range []string{"Authorization", "Cookie", "X-User-Password"} {
+		if val := echo.Headers[name]; len(val) != 1 || val[0] != "REDACTED" {
+			t.Errorf("%s not redacted: %q", name, val)
+		}
+	}
+}
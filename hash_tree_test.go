@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"hash"
+	"math/rand"
+	"testing"
+)
+
+func TestTreeHash(t *testing.T) {
+	// A few chunks plus a partial one at the end.
+	input := make([]byte, 3*treeChunkSize+1234)
+	rand.New(rand.NewSource(1)).Read(input)
+
+	oneShot := newTreeHash(sha512.New)
+	oneShot.Write(input)
+	expected := oneShot.Sum(nil)
+
+	t.Run("doesn't depend on how the input is written", func(t *testing.T) {
+		h := newTreeHash(sha512.New)
+		for data := input; len(data) > 0; {
+			n := min(len(data), 77777)
+			h.Write(data[:n])
+			data = data[n:]
+		}
+		if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+			t.Errorf("Wrong sum:\nHave: %x\nWant: %x", sum, expected)
+		}
+	})
+	t.Run("Sum doesn't change the state", func(t *testing.T) {
+		h := newTreeHash(sha512.New)
+		h.Write(input[:treeChunkSize+5])
+		h.Sum(nil)
+		h.Write(input[treeChunkSize+5:])
+		if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+			t.Errorf("Wrong sum:\nHave: %x\nWant: %x", sum, expected)
+		}
+	})
+	t.Run("Reset starts over", func(t *testing.T) {
+		h := newTreeHash(sha512.New)
+		h.Write([]byte("garbage"))
+		h.Reset()
+		h.Write(input)
+		if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+			t.Errorf("Wrong sum:\nHave: %x\nWant: %x", sum, expected)
+		}
+	})
+	t.Run("is not the same as the plain hash", func(t *testing.T) {
+		if plain := sha512.Sum512(input); bytes.Equal(plain[:], expected) {
+			t.Errorf("Tree hash should differ from plain sha512")
+		}
+	})
+}
+
+// Compare these to see the speedup of the tree mode on a multi-core machine:
+//
+//	go test -bench=Large
+func BenchmarkLargeInput(b *testing.B) {
+	input := make([]byte, 64<<20)
+	rand.New(rand.NewSource(1)).Read(input)
+
+	run := func(newHash func() hash.Hash) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				h := newHash()
+				h.Write(input)
+				h.Sum(nil)
+			}
+		}
+	}
+	b.Run("sha512", run(hashAlgorithms["sha512"]))
+	b.Run("sha512-tree", run(hashAlgorithms["sha512-tree"]))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer func(l *slog.Logger, flags int) {
+		slog.SetDefault(l)
+		log.SetFlags(flags)
+		log.SetOutput(os.Stderr)
+	}(slog.Default(), log.Flags())
+
+	t.Run("json", func(t *testing.T) {
+		var logs bytes.Buffer
+		if err := setupLogging("json", &logs); err != nil {
+			t.Fatal(err)
+		}
+		log.Printf("Loaded %d weak passwords", 3)
+		log.Printf("ERROR: Cannot save task %s: %v", "abc", "disk full")
+		log.Printf("WARNING: pprof is served without auth")
+
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("Not JSON (%v): %s", err, line)
+			}
+			if _, ok := rec["time"]; !ok {
+				t.Errorf("Missing time: %s", line)
+			}
+			records = append(records, rec)
+		}
+		expected := []struct{ level, msg string }{
+			{"INFO", "Loaded 3 weak passwords"},
+			{"ERROR", "Cannot save task abc: disk full"},
+			{"WARN", "pprof is served without auth"},
+		}
+		if len(records) != len(expected) {
+			t.Fatalf("Wrong number of records:\n%s", logs.String())
+		}
+		for i, exp := range expected {
+			if records[i]["level"] != exp.level || records[i]["msg"] != exp.msg {
+				t.Errorf("Wrong record %d: %v", i, records[i])
+			}
+		}
+	})
+	t.Run("text", func(t *testing.T) {
+		log.SetFlags(log.LstdFlags) // json mode clears them
+		var logs bytes.Buffer
+		if err := setupLogging("text", &logs); err != nil {
+			t.Fatal(err)
+		}
+		log.Printf("ERROR: Cannot save task %s", "abc")
+		if !strings.HasSuffix(logs.String(), " ERROR: Cannot save task abc\n") {
+			t.Errorf("Wrong log line: %q", logs.String())
+		}
+	})
+	t.Run("rejects unknown formats", func(t *testing.T) {
+		if err := setupLogging("xml", os.Stderr); err == nil {
+			t.Errorf("Accepted an unknown format")
+		}
+	})
+}
@@ -1,3 +1,8 @@
+// The mux patterns in newMux need Go 1.22 routing, even when built without a
+// go.mod that declares a new enough Go version.
+//
+//go:debug httpmuxgo121=0
+
 // hashex is an example server of an asynchronous hashing service.
 //
 // The overall structure of the code is broken into 4 parts:
@@ -7,7 +12,8 @@
 //      and HashTask provides the actual hash operation.
 //   3. EndPointStatsTracker implements the performance tracking, wrapping the
 //      HashApi endpoint.
-//   4. main() plugs everything together and handles shutdown.
+//   4. main() plugs everything together, for one or more listeners, and
+//      handles shutdown.
 //
 // Graceful shutdown is done via a combination of task.Manager and main. This
 // pierces the HashApi abstraction a bit. :-/
@@ -16,47 +22,281 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/augustoroman/hashex/task"
 )
 
 func main() {
-	port := flag.Int("port", 8080, "Port to serve on")
+	port := flag.Int("port", 8080, "Port to serve on. Use 0 to let the OS "+
+		"pick a free port, see also -addr-file.")
 	bind := flag.String("bind", "127.0.0.1", "IP to bind to for serving. An "+
 		"empty value means to serve on all available interfaces. The default "+
 		"value serves only on the local machine.")
+	unixSocket := flag.String("unix", "", "If set, serve on this Unix domain "+
+		"socket instead of -bind and -port, e.g. behind a local reverse proxy.")
+	var extraListeners listenerFlags
+	flag.Var(&extraListeners, "listen", "ADDR[=ALGO]: Also serve the API on "+
+		"ADDR, using ALGO as the default hash algorithm for requests that "+
+		"arrive there. ADDR can be unix:PATH for a Unix domain socket. May be "+
+		"repeated.")
+	logFormat := flag.String("log-format", "text", "Format of the logs: "+
+		"text, or json for one JSON object per line.")
+	defaultAlgo := flag.String("algo", DefaultAlgorithm, "Default hash "+
+		"algorithm for requests that don't specify one.")
+	hashDelay := flag.Duration("hash-delay", DefaultDelay, "Artificial delay "+
+		"added to each hash. Use 0 to disable it.")
+	idPrefix := flag.String("id-prefix", "", "Prefix for the ids of new "+
+		"hash tasks, e.g. hash- so that they're recognizable in logs.")
+	taskTTL := flag.Duration("task-ttl", 0, "If positive, hash results are "+
+		"forgotten this long after they're computed. By default they're kept "+
+		"forever.")
+	storeDir := flag.String("store-dir", "", "If set, hash results are saved "+
+		"in this directory so that they survive restarts.")
+	storeRedis := flag.String("store-redis", "", "If set, hash results are "+
+		"saved in the Redis server at this host:port instead, so that they "+
+		"survive restarts and can be fetched from any instance sharing it.")
+	workers := flag.Int("workers", 0, "If positive, limits how many hashes "+
+		"are computed at once (per listener). The rest wait their turn.")
+	maxQueued := flag.Int("max-queued", 0, "If positive (and -workers is "+
+		"set), limits how many hashes can wait their turn before new ones are "+
+		"rejected with 503.")
+	pendingStatus := flag.Int("pending-status", 0, "If non-zero, requests for "+
+		"a result that isn't ready yet immediately get this status code (e.g. "+
+		"425) instead of waiting for the result.")
+	pollTimeout := flag.Duration("poll-timeout", 0, "How long result "+
+		"requests that don't block (see -pending-status and ?wait=false) "+
+		"wait for the result before responding that it's still processing.")
+	statsResetInterval := flag.Duration("stats-reset-interval", 0, "If "+
+		"positive, the stats are logged and reset this often so that they "+
+		"reflect recent behavior. By default they cover the server's lifetime.")
+	statsWindow := flag.Duration("stats-window", time.Minute, "The stats "+
+		"also report the calls in this sliding window of recent time, in "+
+		"addition to the totals. Use 0 to disable it.")
+	maxWait := flag.Duration("max-wait", 0, "If positive, requests for a "+
+		"result never block longer than this, even if they ask to with the "+
+		"X-Max-Wait-Ms header (which is otherwise capped at 1m). Either way, "+
+		"waits end a few seconds before the -write-timeout.")
+	maxWaiting := flag.Int("max-waiting", 0, "If positive, limits the number "+
+		"of requests that can be waiting for hash results at once.")
+	maxInFlight := flag.Int("max-in-flight", 0, "If positive, new hash "+
+		"requests are rejected with a 503 while this many hashes are in "+
+		"progress.")
+	maxBytes := flag.Int64("max-bytes-per-minute", 0, "If positive, limits "+
+		"the total size of the inputs accepted for hashing each minute, across "+
+		"all listeners.")
+	addrFile := flag.String("addr-file", "", "If set, the address that the "+
+		"server is actually listening on is written to this file once it's "+
+		"ready. Useful with -port 0 so that tests can find the server.")
+	statusPage := flag.Bool("status-page", true, "Serve a human-readable "+
+		"status page at /.")
+	extraHeaders := headerFlags{}
+	flag.Var(extraHeaders, "header", "'Name: value' header to add to every "+
+		"response, e.g. 'X-Content-Type-Options: nosniff'. May be repeated.")
+	minLength := flag.Int("min-length", 0, "If positive, inputs shorter than "+
+		"this many bytes are rejected.")
+	maxLength := flag.Int("max-length", 0, "If positive, inputs longer than "+
+		"this many bytes are rejected.")
+	maxFileSize := flag.Int64("max-file-size", DefaultMaxFileSize, "The "+
+		"largest file or raw body, in bytes, that can be uploaded for hashing.")
+	maxIterations := flag.Int("max-iterations", DefaultMaxIterations, "The "+
+		"most iterations that a request can ask for to stretch its hash.")
+	maxBatchSize := flag.Int("max-batch-size", DefaultMaxBatchSize, "The "+
+		"most passwords that can be hashed with one POST /hash/batch request.")
+	weakPasswordFile := flag.String("weak-password-file", "", "If set, "+
+		"passwords listed in this file (one per line) are rejected. The file "+
+		"is reloaded on SIGHUP.")
+	hmacKey := flag.String("hmac-key", "", "The secret key for the hmac-* "+
+		"algorithms. Flags are visible to anyone who can list processes, so "+
+		"prefer setting $"+hmacKeyEnv+" instead.")
+	verboseErrors := flag.Bool("verbose-errors", false, "Include internal "+
+		"error messages in error responses. Only use this for internal "+
+		"services since it may expose internal details to clients.")
+	var timeouts serverTimeouts
+	flag.DurationVar(&timeouts.ReadHeader, "read-header-timeout", 5*time.Second,
+		"How long clients have to send the request headers.")
+	flag.DurationVar(&timeouts.Read, "read-timeout", 30*time.Second, "How "+
+		"long clients have to send the entire request, including the body.")
+	flag.DurationVar(&timeouts.Write, "write-timeout", time.Minute, "How "+
+		"long a request has to be handled and the response written. Waiting "+
+		"for a hash result counts against this, so it should be comfortably "+
+		"longer than -hash-delay, and waits are cut short to fit in it.")
+	flag.DurationVar(&timeouts.Idle, "idle-timeout", 2*time.Minute, "How "+
+		"long to keep idle keep-alive connections open.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How "+
+		"long to wait for running hashes and requests to finish when shutting "+
+		"down before giving up on them. Use 0 to wait indefinitely.")
+	serveExpvar := flag.Bool("expvar", false, "Serve runtime metrics and task "+
+		"counts at /debug/vars. They're mostly harmless, but they do reveal "+
+		"the command line, including this server's flags.")
+	pprofAddr := flag.String("pprof-addr", "", "If set, serve the pprof "+
+		"profiling endpoints at /debug/pprof/ on this separate address, e.g. "+
+		"localhost:6060. Profiles are limited by -write-timeout.")
+	pprofUser := flag.String("pprof-user", "", "If set, the pprof endpoints "+
+		"require HTTP basic auth with this user and -pprof-pass.")
+	pprofPass := flag.String("pprof-pass", "", "The password for -pprof-user.")
+	adminToken := flag.String("admin-token", "", "If set, serve the admin "+
+		"endpoints (POST /admin/cancel-all) to requests with this bearer token.")
+	devMode := flag.Bool("dev", false, "Enable development-only endpoints "+
+		"such as /debug/echo and listing tasks with GET /hash. Never enable "+
+		"this in production.")
 	flag.Parse()
 
-	server := &http.Server{
-		Addr: net.JoinHostPort(*bind, fmt.Sprint(*port)),
-		// In a real production env, also set timeouts defensively. Ref:
-		//   https://blog.cloudflare.com/exposing-go-on-the-internet/
+	if err := setupLogging(*logFormat, os.Stderr); err != nil {
+		log.Fatalf("Bad -log-format flag: %v", err)
 	}
+	if err := checkAlgorithms(*defaultAlgo); err != nil {
+		log.Fatalf("Bad -algo flag: %v", err)
+	}
+	addr := net.JoinHostPort(*bind, fmt.Sprint(*port))
+	if *unixSocket != "" {
+		addr = unixPrefix + *unixSocket
+	}
+	listeners := append(listenerFlags{{Addr: addr, Algo: *defaultAlgo}}, extraListeners...)
 
-	var hashApi HashApi
-	var perf EndPointStatsTracker
+	if *hmacKey == "" {
+		*hmacKey = os.Getenv(hmacKeyEnv)
+	}
+	for _, l := range listeners {
+		if *hmacKey == "" && usesHMAC(l.Algo) {
+			log.Fatalf("%s defaults to %s, but there's no HMAC key: set "+
+				"-hmac-key or $%s", l.Addr, l.Algo, hmacKeyEnv)
+		}
+	}
 
-	// I like hooking everything up in one place so you can easily see the
-	// complete map of incoming requests -> handlers, even if that's 100s of
-	// lines long. Also, a proper mux would allow separating out POST vs GEt
-	// here rather than in the handlers.
-	http.HandleFunc("/hash", perf.Track(hashApi.Start))
-	http.HandleFunc("/hash/", hashApi.GetResult)
-	http.HandleFunc("/stats", perf.ServeHTTP)
+	perf := EndPointStatsTracker{
+		AutoResetInterval: *statsResetInterval,
+		RecentWindow:      *statsWindow,
+	}
+	started := time.Now()
+	statsCtx, stopStats := context.WithCancel(context.Background())
+	go perf.RunAutoReset(statsCtx)
 
-	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "Shutting down")
-		go server.Shutdown(context.Background())
-	})
+	longestWait := *maxWait
+	if longestWait <= 0 {
+		longestWait = DefaultMaxRequestedWait
+	}
+	if timeouts.Write > 0 && timeouts.Write <= max(*hashDelay, longestWait) {
+		log.Printf("WARNING: -write-timeout %v is too short to wait for hash "+
+			"results, waits are capped at %v and get a pending response "+
+			"after that.", timeouts.Write, maxWaitFor(timeouts.Write, *maxWait))
+	}
+
+	// HashApi treats a zero delay as "use the default", so disabling the delay
+	// has to be spelled differently.
+	delay := *hashDelay
+	if delay == 0 {
+		delay = -1
+	}
+
+	var weakPasswords *PasswordList
+	if *weakPasswordFile != "" {
+		weakPasswords = &PasswordList{}
+		if err := weakPasswords.Load(*weakPasswordFile); err != nil {
+			log.Fatalf("Cannot load weak passwords: %v", err)
+		}
+		log.Printf("Loaded %d weak passwords", weakPasswords.Len())
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := weakPasswords.Load(*weakPasswordFile); err != nil {
+					log.Printf("ERROR: Cannot reload weak passwords, keeping "+
+						"the old list: %v", err)
+				} else {
+					log.Printf("Reloaded %d weak passwords", weakPasswords.Len())
+				}
+			}
+		}()
+	}
+
+	// Each listener gets its own server and HashApi, so they only differ in
+	// their default algorithm. Note that this means that tasks started on one
+	// listener can't be retrieved from another until they've completed, and
+	// only with -store-dir or -store-redis: the listeners share the store, and
+	// each one loads the completed tasks it doesn't know about from it.
+	var store task.Store
+	switch {
+	case *storeDir != "" && *storeRedis != "":
+		log.Fatalf("Only one of -store-dir and -store-redis can be set")
+	case *storeDir != "":
+		if err := os.MkdirAll(*storeDir, 0700); err != nil {
+			log.Fatalf("Cannot create -store-dir: %v", err)
+		}
+		store = task.DirStore(*storeDir)
+	case *storeRedis != "":
+		store = &task.RedisStore{Addr: *storeRedis, Prefix: "hashex:task:"}
+	}
+
+	var taskVars *expvar.Map
+	if *serveExpvar {
+		taskVars = expvar.NewMap("tasks") // shared by all listeners
+		expvar.Publish("stats", expvar.Func(func() interface{} { return perf.Snapshot() }))
+	}
+
+	// The byte budget is shared too, so that -max-bytes-per-minute limits the
+	// server as a whole rather than each listener.
+	bytes := &ByteBudget{}
+
+	var servers []*http.Server
+	var apis []*HashApi
+	draining := make(chan struct{})
+	var startDraining sync.Once
+	shutdownAll := func() {
+		startDraining.Do(func() { close(draining) })
+	}
+	for _, l := range listeners {
+		hashApi := &HashApi{
+			DefaultAlgo:       l.Algo,
+			Delay:             delay,
+			PendingStatus:     *pendingStatus,
+			PollTimeout:       *pollTimeout,
+			MaxWait:           maxWaitFor(timeouts.Write, *maxWait),
+			MaxBytesPerWindow: *maxBytes,
+			Bytes:             bytes,
+			MaxWaiting:        *maxWaiting,
+			MaxInFlight:       *maxInFlight,
+			MinLength:         *minLength,
+			MaxLength:         *maxLength,
+			MaxFileSize:       *maxFileSize,
+			MaxBatchSize:      *maxBatchSize,
+			MaxIterations:     *maxIterations,
+			WeakPasswords:     weakPasswords,
+			HMACKey:           []byte(*hmacKey),
+			VerboseErrors:     *verboseErrors,
+		}
+		hashApi.Tasks.TTL = *taskTTL
+		hashApi.Tasks.IdPrefix = *idPrefix
+		hashApi.Tasks.MaxConcurrent = *workers
+		hashApi.Tasks.MaxQueued = *maxQueued
+		hashApi.Tasks.Vars = taskVars
+		hashApi.Tasks.Store = store
+		mux := newMux(hashApi, &perf, muxConfig{
+			StatusPage: *statusPage,
+			DevMode:    *devMode,
+			Expvar:     *serveExpvar,
+			Started:    started,
+			Shutdown:   shutdownAll,
+			AdminToken: *adminToken,
+		})
 
-	// TODO(aroman) Prod should have consistent access logs for all endpoints.
-	// TODO(aroman) Prod should have secured pprof and expvar endpoints.
+		handler := logRequests(recoverPanic(withHeaders(http.Header(extraHeaders), mux)))
+		servers = append(servers, newServer(l.Addr, handler, timeouts))
+		apis = append(apis, hashApi)
+	}
 
 	// Handle ^C cleanly. To be a good citizen, the first ^C is consumed and
 	// shutdown is initiated, but any further ^Cs are handled by the OS, which
@@ -66,16 +306,296 @@ func main() {
 	go func() {
 		<-interrupt
 		signal.Reset(os.Interrupt) // A second ^C kills the server immediately.
-		server.Shutdown(context.Background())
+		shutdownAll()
 	}()
 
-	log.Printf("Starting hash API server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("Cannot start server: %v", err)
+	var serving sync.WaitGroup
+	for i, server := range servers {
+		listener, err := listen(server)
+		if err != nil {
+			log.Fatalf("Cannot start server: %v", err)
+		}
+		log.Printf("Hash API server listening on %s (default algo: %s)",
+			server.Addr, listeners[i].Algo)
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				log.Fatalf("Server failed: %v", err)
+			}
+		}()
+	}
+	if *pprofAddr != "" {
+		var handler http.Handler = pprofHandler()
+		if *pprofUser != "" || *pprofPass != "" {
+			handler = basicAuth(*pprofUser, *pprofPass, handler)
+		} else {
+			log.Printf("WARNING: pprof is served without auth, make sure " +
+				"that -pprof-addr isn't reachable by the public.")
+		}
+		server := newServer(*pprofAddr, logRequests(handler), timeouts)
+		listener, err := listen(server)
+		if err != nil {
+			log.Fatalf("Cannot start pprof server: %v", err)
+		}
+		log.Printf("pprof server listening on %s", server.Addr)
+		// There's nothing to drain on shutdown, so just let it die with the
+		// process.
+		go server.Serve(listener)
 	}
+	if *addrFile != "" {
+		if err := os.WriteFile(*addrFile, []byte(servers[0].Addr+"\n"), 0644); err != nil {
+			log.Fatalf("Cannot write address file: %v", err)
+		}
+	}
+	<-draining
+	stopStats()
 
 	log.Printf("Waiting for running tasks && active requests to finish.")
-	ctx := context.Background() // Wait indefinitely for shutdown.
-	hashApi.Tasks.Shutdown(ctx) // Wait for all tasks to finish.
-	server.Shutdown(ctx)        // Wait for all in-flight requests to finish.
+	ctx := context.Background()
+	if *shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *shutdownTimeout)
+		defer cancel()
+	}
+	drain(ctx, apis, servers)
+	serving.Wait()
+}
+
+// drain shuts everything down gracefully, giving up once the context is done:
+//
+//  1. The task managers stop taking new tasks, so new hash requests get a 503
+//     and /healthz reports "draining" for the load balancer's benefit.
+//  2. The servers keep serving meanwhile, so that the clients of the running
+//     tasks can still get their results, whether they were already waiting
+//     or only ask once the task is done. If the context is done first, the
+//     unfinished tasks are cancelled, and their waiters get a 503.
+//  3. Then the servers stop accepting connections and wait for the requests
+//     in flight to finish.
+//
+// NOTE(aroman) Results can't be fetched after the servers stop (unless there's
+// a -store-dir or -store-redis), so clients that poll rather than wait should
+// poll often.
+func drain(ctx context.Context, apis []*HashApi, servers []*http.Server) {
+	var wg sync.WaitGroup
+	for _, hashApi := range apis {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shutdownTasks(ctx, &hashApi.Tasks); err != nil {
+				log.Printf("Gave up waiting for tasks: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Gave up waiting for requests: %v", err)
+		}
+	}
+}
+
+// pprofHandler serves the pprof endpoints. It's kept off of the API's mux so
+// that it can be served on an internal-only address.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// muxConfig holds the settings that affect which endpoints newMux serves.
+type muxConfig struct {
+	StatusPage bool      // serve the status page at /
+	DevMode    bool      // serve development-only endpoints
+	Expvar     bool      // serve /debug/vars
+	Started    time.Time // when the server started, for the status page
+	Shutdown   func()    // initiates shutdown, for /shutdown
+	AdminToken string    // serve the admin endpoints to those with this token
+}
+
+// newMux hooks up all of the endpoints for one listener.
+func newMux(hashApi *HashApi, perf *EndPointStatsTracker, cfg muxConfig) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// I like hooking everything up in one place so you can easily see the
+	// complete map of incoming requests -> handlers, even if that's 100s of
+	// lines long. The mux takes care of the methods: a request for a known
+	// path with the wrong method gets 405.
+	mux.HandleFunc("POST /hash", perf.Track("hash", hashApi.Start))
+	mux.HandleFunc("GET /hash/{id}", hashApi.GetResult)
+	mux.HandleFunc("DELETE /hash/{id}", hashApi.Delete)
+	mux.HandleFunc("POST /hash/sync", perf.Track("sync", hashApi.Sync))
+	mux.HandleFunc("POST /hash/verify", perf.Track("verify", hashApi.Verify))
+	mux.HandleFunc("POST /hash/batch", perf.Track("batch", hashApi.Batch))
+	mux.HandleFunc("GET /hash/batch", hashApi.WaitMany)
+	mux.HandleFunc("GET /healthz", hashApi.Healthz)
+	mux.HandleFunc("GET /debug/tasks", hashApi.TaskMetrics)
+	mux.HandleFunc("GET /stats", statsHandler(perf, hashApi))
+	// TODO(aroman) Auth checks here? Anyone can wipe out the stats.
+	mux.HandleFunc("POST /stats/reset", perf.ServeReset)
+	mux.HandleFunc("GET /metrics", prometheusHandler(perf, hashApi))
+	if cfg.StatusPage {
+		mux.Handle("GET /{$}", StatusPage{perf, hashApi, cfg.Started})
+	}
+
+	if cfg.Expvar {
+		mux.Handle("GET /debug/vars", expvar.Handler())
+	}
+
+	if cfg.DevMode {
+		// Listing the tasks reveals their ids, which is all that's needed to
+		// fetch their results, so only allow that in dev mode.
+		mux.HandleFunc("GET /hash", hashApi.List)
+		mux.HandleFunc("/debug/echo", debugEcho)
+	}
+
+	// Without a token there's no way to guard these, so they don't exist.
+	if cfg.AdminToken != "" {
+		mux.Handle("POST /admin/cancel-all",
+			requireToken(cfg.AdminToken, http.HandlerFunc(hashApi.CancelAll)))
+	}
+
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Shutting down")
+		if cfg.Shutdown != nil {
+			cfg.Shutdown()
+		}
+	})
+	return mux
+}
+
+// shutdownTasks shuts down the task manager, giving up once the context is
+// done. If it gives up, it logs the tasks that were still unfinished, since
+// they're about to be cancelled.
+func shutdownTasks(ctx context.Context, tasks *task.Manager) error {
+	// The Manager cancels whatever is unfinished as soon as its context is
+	// done, so take note of what that is first.
+	giveUp, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			for _, info := range tasks.List() {
+				if info.Status == task.Pending || info.Status == task.Running {
+					log.Printf("Task %s (%s) is still %s", info.Id, info.Type, info.Status)
+				}
+			}
+			cancel()
+		}
+	}()
+	if err := tasks.Shutdown(giveUp); err != nil {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// listenerFlags are the -listen flag values: addresses to serve on, each with
+// its own default hash algorithm.
+type listenerFlags []struct{ Addr, Algo string }
+
+func (l *listenerFlags) String() string {
+	var parts []string
+	for _, listener := range *l {
+		parts = append(parts, listener.Addr+"="+listener.Algo)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *listenerFlags) Set(val string) error {
+	addr, algo, _ := strings.Cut(val, "=")
+	if algo == "" {
+		algo = DefaultAlgorithm
+	}
+	if err := checkAlgorithms(algo); err != nil {
+		return err
+	}
+	*l = append(*l, struct{ Addr, Algo string }{addr, algo})
+	return nil
+}
+
+// hmacKeyEnv is the environment variable with the HMAC key, if the -hmac-key
+// flag isn't set.
+const hmacKeyEnv = "HASHEX_HMAC_KEY"
+
+// serverTimeouts are the http.Server timeouts, see the corresponding flags.
+// Zero means no timeout. Ref:
+//   https://blog.cloudflare.com/exposing-go-on-the-internet/
+type serverTimeouts struct {
+	ReadHeader, Read, Write, Idle time.Duration
+}
+
+// newServer creates the server for a listener with the given timeouts. Serving
+// on the open internet without them lets slow or stalled clients hold
+// connections (and goroutines) open forever.
+func newServer(addr string, handler http.Handler, timeouts serverTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
+}
+
+// writeTimeoutMargin is how much of the write timeout is left for writing the
+// response after waiting for a hash result, at most, see maxWaitFor.
+const writeTimeoutMargin = 5 * time.Second
+
+// maxWaitFor returns the HashApi.MaxWait to use with the given write timeout:
+// maxWait, unless waiting that long (or DefaultMaxRequestedWait, or forever,
+// if it's not set) would run into the write timeout. Then the wait ends a bit
+// earlier, so that clients get a pending response instead of a dropped
+// connection.
+func maxWaitFor(writeTimeout, maxWait time.Duration) time.Duration {
+	if writeTimeout <= 0 {
+		return maxWait
+	}
+	limit := writeTimeout - min(writeTimeoutMargin, writeTimeout/10)
+	if maxWait <= 0 || maxWait > limit {
+		return limit
+	}
+	return maxWait
+}
+
+// unixPrefix marks addresses that are Unix domain socket paths rather than TCP
+// addresses, e.g. "unix:/run/hashex.sock".
+const unixPrefix = "unix:"
+
+// listen binds the server's address and updates server.Addr to the address
+// that was actually bound. Those differ when binding to port 0, for example,
+// and this way anyone holding the server can discover the real address.
+//
+// Addresses starting with unixPrefix are Unix domain sockets. The socket file
+// is removed when the listener is closed (e.g. by server.Shutdown), and a
+// stale one left behind by a crash is replaced, but not one that's in use.
+func listen(server *http.Server) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(server.Addr, unixPrefix); ok {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: already in use", path)
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		server.Addr = unixPrefix + l.Addr().String()
+		return l, nil
+	}
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	server.Addr = l.Addr().String()
+	return l, nil
 }
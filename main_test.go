@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/augustoroman/hashex/task"
+)
+
+func TestListen(t *testing.T) {
+	t.Run("reports the bound address", func(t *testing.T) {
+		server := &http.Server{Addr: "127.0.0.1:0"}
+		l, err := listen(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if server.Addr != l.Addr().String() {
+			t.Errorf("Server addr %q doesn't match the listener %q", server.Addr, l.Addr())
+		}
+		if _, port, _ := net.SplitHostPort(server.Addr); port == "0" || port == "" {
+			t.Errorf("Didn't resolve the real port: %q", server.Addr)
+		}
+	})
+	t.Run("listens on Unix domain sockets", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "hashex.sock")
+		server := &http.Server{Addr: "unix:" + path}
+		l, err := listen(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Addr().Network() != "unix" || server.Addr != "unix:"+path {
+			t.Errorf("Wrong address: %s %q", l.Addr().Network(), server.Addr)
+		}
+
+		// It's really serving there.
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}))
+		client := http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", path)
+			},
+		}}
+		resp, err := client.Get("http://hashex/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		if string(body) != "hello" {
+			t.Errorf("Wrong response: %q", body)
+		}
+
+		// Can't take over a socket that's in use...
+		if l2, err := listen(&http.Server{Addr: "unix:" + path}); err == nil {
+			l2.Close()
+			t.Errorf("Took over a socket that's in use")
+		}
+		// ...and the socket is cleaned up once it's closed.
+		l.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Socket file is still there: %v", err)
+		}
+	})
+	t.Run("replaces stale Unix domain sockets", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "hashex.sock")
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Like a crash would: leave the file behind, but nobody's listening.
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+		l, err := listen(&http.Server{Addr: "unix:" + path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	})
+	t.Run("fails if the address is taken", func(t *testing.T) {
+		taken, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer taken.Close()
+		server := &http.Server{Addr: taken.Addr().String()}
+		if l, err := listen(server); err == nil {
+			l.Close()
+			t.Fatalf("Expected an error binding to %s", taken.Addr())
+		}
+	})
+}
+
+func TestNewServer(t *testing.T) {
+	timeouts := serverTimeouts{
+		ReadHeader: 1 * time.Second,
+		Read:       2 * time.Second,
+		Write:      3 * time.Second,
+		Idle:       4 * time.Second,
+	}
+	server := newServer("127.0.0.1:0", http.NotFoundHandler(), timeouts)
+	if server.Addr != "127.0.0.1:0" {
+		t.Errorf("Wrong addr: %q", server.Addr)
+	}
+	if server.Handler == nil {
+		t.Errorf("Missing handler")
+	}
+	got := serverTimeouts{
+		server.ReadHeaderTimeout,
+		server.ReadTimeout,
+		server.WriteTimeout,
+		server.IdleTimeout,
+	}
+	if got != timeouts {
+		t.Errorf("Wrong timeouts:\n  got  %+v\n  want %+v", got, timeouts)
+	}
+}
+
+func TestMaxWaitFor(t *testing.T) {
+	for _, tc := range []struct {
+		writeTimeout, maxWait, want time.Duration
+	}{
+		{0, 0, 0},
+		{0, time.Hour, time.Hour},
+		{time.Minute, 0, 55 * time.Second},
+		{time.Minute, time.Minute, 55 * time.Second},
+		{time.Minute, 10 * time.Second, 10 * time.Second},
+		{10 * time.Second, 0, 9 * time.Second},
+		{2 * time.Minute, 0, 115 * time.Second},
+	} {
+		if got := maxWaitFor(tc.writeTimeout, tc.maxWait); got != tc.want {
+			t.Errorf("maxWaitFor(%v, %v) = %v, want %v", tc.writeTimeout, tc.maxWait, got, tc.want)
+		}
+	}
+}
+
+func TestListenerFlags(t *testing.T) {
+	var l listenerFlags
+	if err := l.Set(":9000=sha512-tree"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("127.0.0.1:9001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set(":9002=rot13"); err == nil {
+		t.Errorf("Accepted an unknown algorithm")
+	}
+	if s := l.String(); s != ":9000=sha512-tree,127.0.0.1:9001=sha512" {
+		t.Errorf("Wrong listeners: %s", s)
+	}
+}
+
+func TestShutdownTasks(t *testing.T) {
+	t.Run("waits for tasks to finish", func(t *testing.T) {
+		var tm task.Manager
+		id, _ := tm.Start(HashTask{Password: "angryMonkey", Delay: 10 * time.Millisecond})
+		if err := shutdownTasks(context.Background(), &tm); err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := tm.Status(id); status != task.Done {
+			t.Errorf("Task is %s, not done", status)
+		}
+	})
+	t.Run("gives up after the deadline and logs unfinished tasks", func(t *testing.T) {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		var tm task.Manager
+		id, _ := tm.Start(HashTask{Password: "angryMonkey", Delay: time.Hour})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if err := shutdownTasks(ctx, &tm); err != context.DeadlineExceeded {
+			t.Errorf("Wrong error: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Took too long to give up: %v", elapsed)
+		}
+		if !strings.Contains(logs.String(), string(id)) {
+			t.Errorf("Didn't log the unfinished task %s:\n%s", id, logs.String())
+		}
+		// The hash is context-aware, so it's cancelled when shutdown gives up
+		// and reported as abandoned.
+		if _, err := tm.Wait(context.Background(), id); err != task.ErrAbandoned {
+			t.Errorf("Task wasn't abandoned: %v", err)
+		}
+	})
+}
+
+func TestDrain(t *testing.T) {
+	// serveApi serves the api for real, since drain shuts the server down.
+	serveApi := func(t *testing.T, api *HashApi) (*http.Server, string) {
+		mux := newMux(api, &EndPointStatsTracker{}, muxConfig{})
+		server := newServer("127.0.0.1:0", mux, serverTimeouts{})
+		l, err := listen(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(l)
+		return server, "http://" + server.Addr
+	}
+	get := func(url string) (int, string) {
+		resp, err := http.Get(url)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// waitFor starts waiting for the result of the task in the background.
+	waitFor := func(api *HashApi, url string) chan string {
+		waited := make(chan string, 1)
+		go func() {
+			code, body := get(url)
+			waited <- fmt.Sprint(code, " ", strings.TrimSpace(body))
+		}()
+		for start := time.Now(); api.waiting.Load() == 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("Never started waiting")
+			}
+		}
+		return waited
+	}
+
+	t.Run("finishes running tasks", func(t *testing.T) {
+		api := withSequentialIds(&HashApi{MaxWaiting: 10})
+		block := blockingTask(make(chan struct{}))
+		api.Tasks.Start(block)
+		server, base := serveApi(t, api)
+		waited := waitFor(api, base+"/hash/1")
+
+		drained := make(chan struct{})
+		go func() {
+			drain(context.Background(), []*HashApi{api}, []*http.Server{server})
+			close(drained)
+		}()
+		for !api.Tasks.IsShuttingDown() {
+			time.Sleep(time.Millisecond)
+		}
+
+		// It's still serving, but not taking new work.
+		if code, body := get(base + "/healthz"); code != http.StatusServiceUnavailable || body != `{"status":"draining"}`+"\n" {
+			t.Errorf("Wrong health: %d %s", code, body)
+		}
+		resp, err := http.Post(base+"/hash", "application/x-www-form-urlencoded", strings.NewReader("password=angryMonkey"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Started a hash while draining: %d", resp.StatusCode)
+		}
+		select {
+		case <-drained:
+			t.Fatalf("Didn't wait for the running task")
+		default:
+		}
+
+		// The waiter gets its result once the task is done, and then the
+		// server shuts down.
+		close(block)
+		select {
+		case res := <-waited:
+			if res != `200 "finished"` {
+				t.Errorf("Wrong result: %s", res)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Waiter never got the result")
+		}
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+			t.Fatalf("Never finished draining")
+		}
+		if code, body := get(base + "/healthz"); code != 0 {
+			t.Errorf("Still serving: %d %s", code, body)
+		}
+	})
+	t.Run("gives up after the deadline", func(t *testing.T) {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		api := withSequentialIds(&HashApi{MaxWaiting: 10})
+		block := blockingTask(make(chan struct{}))
+		defer close(block)
+		api.Tasks.Start(block)
+		server, base := serveApi(t, api)
+		waited := waitFor(api, base+"/hash/1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		drain(ctx, []*HashApi{api}, []*http.Server{server})
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Took too long to give up: %v", elapsed)
+		}
+		// The waiter is told that the task was abandoned.
+		select {
+		case res := <-waited:
+			if !strings.HasPrefix(res, "503 ") || !strings.Contains(res, `"shutting_down"`) {
+				t.Errorf("Wrong response: %s", res)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Waiter was never released")
+		}
+		if !strings.Contains(logs.String(), "Gave up waiting for tasks") {
+			t.Errorf("Didn't log giving up:\n%s", logs.String())
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// withHeaders adds the provided headers to every response. They're added
+// before calling the handler, so a handler that intentionally sets one of
+// them (e.g. Content-Type) wins.
+func withHeaders(headers http.Header, next http.Handler) http.Handler {
+	if len(headers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, vals := range headers {
+			w.Header()[name] = append([]string(nil), vals...)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerFlags collects repeated "Name: value" flags into an http.Header.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	var parts []string
+	for name, vals := range h {
+		for _, val := range vals {
+			parts = append(parts, name+": "+val)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h headerFlags) Set(flag string) error {
+	name, val, ok := strings.Cut(flag, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("expected 'Name: value', got %q", flag)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(val))
+	return nil
+}
+
+// basicAuth only lets requests through to next if they have HTTP basic auth
+// credentials for the user and password. Others get a 401 challenge.
+func basicAuth(user, pass string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		// Compare both, even if the user is wrong, so that the timing doesn't
+		// reveal which one it was.
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		if !ok || !userOk || !passOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hashex", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireToken only lets requests through to next if they have the token as
+// a bearer token (Authorization: Bearer <token>). Others get a 401.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hashex"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequests writes an access log line for every request, in logfmt so that
+// it's both readable and easy to parse.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			log.Printf("method=%s path=%q status=%d bytes=%d duration=%v",
+				r.Method, r.URL.Path, rec.Status(), rec.size, time.Since(start))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// methodNotAllowed responds with 405 and the Allow header listing the methods
+// that the resource does support. The mux does this itself for its patterns,
+// this is for handlers that can also be mounted elsewhere.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+// recoverPanic turns a panicking handler into a 500 with a JSON error body,
+// rather than letting net/http log it and drop the connection. The panic is
+// logged along with the request id, which is also returned to the client in
+// the X-Request-Id header so that a bug report can be matched to the log.
+//
+// If the handler already started the response, the status can't be changed
+// anymore, so the response is just cut short.
+func recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// ErrAbortHandler is the sanctioned way to abort a response, so
+			// it's never recovered.
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			id := requestId(r)
+			log.Printf("ERROR: Panic serving %s %s (request_id=%s): %v\n%s",
+				r.Method, r.URL.Path, id, p, debug.Stack())
+			if rec.status == 0 {
+				w.Header().Set("X-Request-Id", id)
+				writeJSONError(w, http.StatusInternalServerError, "internal",
+					"Sorry, something went wrong.")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// requestId returns the id that the client (or a proxy in front of us) gave
+// the request, or makes one up.
+//
+// TODO(aroman): Assign ids to every request up front so that they can also be
+// included in the access log, not just when something goes wrong.
+func requestId(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// statusRecorder wraps a ResponseWriter to capture the status code and size of
+// the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	// Informational (1xx) responses are followed by the real one.
+	if s.status == 0 && code >= 200 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// Status returns the status code of the response. If the handler never wrote
+// anything, that's an implicit 200.
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithHeaders(t *testing.T) {
+	headers := headerFlags{}
+	for _, flag := range []string{
+		"X-Content-Type-Options: nosniff",
+		"Cache-Control: no-store",
+		"Content-Type: text/plain",
+		"X-Custom:a",
+		"X-Custom:b",
+	} {
+		if err := headers.Set(flag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := headers.Set("no colon"); err == nil {
+		t.Errorf("Accepted a header without a value")
+	}
+
+	handler := withHeaders(http.Header(headers), http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		}))
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(w, r)
+
+	expected := http.Header{
+		"X-Content-Type-Options": {"nosniff"},
+		"Cache-Control":          {"no-store"},
+		"Content-Type":           {"application/json"}, // the handler wins
+		"X-Custom":               {"a", "b"},
+	}
+	if !reflect.DeepEqual(w.Header(), expected) {
+		t.Errorf("Wrong headers:\nHave: %v\nWant: %v", w.Header(), expected)
+	}
+	// The configured headers must not be modified by handlers.
+	if ct := http.Header(headers).Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Configured headers were modified: %v", headers)
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	handler := logRequests(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("hello"))
+			w.Write([]byte(" world"))
+		}))
+	w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/hash", nil)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusAccepted || w.Body.String() != "hello world" {
+		t.Errorf("Response was altered: %d %q", w.Code, w.Body.String())
+	}
+	line := logs.String()
+	for _, field := range []string{
+		`method=POST`, `path="/hash"`, `status=202`, `bytes=11`, `duration=`,
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("Missing %s in log line: %s", field, line)
+		}
+	}
+
+	t.Run("implicit 200", func(t *testing.T) {
+		logs.Reset()
+		handler := logRequests(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if !strings.Contains(logs.String(), "status=200 bytes=0") {
+			t.Errorf("Wrong log line: %s", logs.String())
+		}
+	})
+}
+
+func TestBasicAuth(t *testing.T) {
+	handler := basicAuth("admin", "s3cret", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("welcome"))
+		}))
+	for _, test := range []struct {
+		name       string
+		user, pass string
+		noAuth     bool
+		expected   int
+	}{
+		{name: "missing credentials", noAuth: true, expected: http.StatusUnauthorized},
+		{name: "wrong user", user: "root", pass: "s3cret", expected: http.StatusUnauthorized},
+		{name: "wrong password", user: "admin", pass: "guess", expected: http.StatusUnauthorized},
+		{name: "correct credentials", user: "admin", pass: "s3cret", expected: http.StatusOK},
+	} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/pprof/", nil)
+		if !test.noAuth {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.expected, w.Code, w.Body.String())
+		}
+		if test.expected == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing the WWW-Authenticate challenge", test.name)
+		}
+		if test.expected == http.StatusOK && w.Body.String() != "welcome" {
+			t.Errorf("%s: wrong body %q", test.name, w.Body.String())
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("s3cret", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("welcome"))
+		}))
+	for _, test := range []struct {
+		name, auth string
+		expected   int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"wrong scheme", "Basic s3cret", http.StatusUnauthorized},
+		{"correct token", "Bearer s3cret", http.StatusOK},
+	} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/cancel-all", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.expected, w.Code, w.Body.String())
+		}
+		if test.expected == http.StatusOK && w.Body.String() != "welcome" {
+			t.Errorf("%s: wrong body %q", test.name, w.Body.String())
+		}
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	handler := logRequests(recoverPanic(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			panic("monkey business")
+		})))
+
+	t.Run("responds with a clean 500", func(t *testing.T) {
+		logs.Reset()
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/hash/1", nil)
+		r.Header.Set("X-Request-Id", "req-42")
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Wrong status: %d", w.Code)
+		}
+		if code, _ := jsonError(t, w); code != "internal" {
+			t.Errorf("Wrong error code: %q", code)
+		}
+		if id := w.Header().Get("X-Request-Id"); id != "req-42" {
+			t.Errorf("Wrong request id: %q", id)
+		}
+		for _, msg := range []string{"monkey business", "request_id=req-42", "status=500"} {
+			if !strings.Contains(logs.String(), msg) {
+				t.Errorf("Missing %q in the logs:\n%s", msg, logs.String())
+			}
+		}
+	})
+	t.Run("makes up a request id", func(t *testing.T) {
+		logs.Reset()
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		handler.ServeHTTP(w, r)
+		id := w.Header().Get("X-Request-Id")
+		if id == "" || !strings.Contains(logs.String(), "request_id="+id) {
+			t.Errorf("Wrong request id %q:\n%s", id, logs.String())
+		}
+	})
+	t.Run("can't change a response that was already started", func(t *testing.T) {
+		handler := recoverPanic(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("partial"))
+				panic("oops")
+			}))
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "partial" {
+			t.Errorf("Response was altered: %d %q", w.Code, w.Body.String())
+		}
+	})
+	t.Run("doesn't recover aborted handlers", func(t *testing.T) {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("Wrong panic: %v", p)
+			}
+		}()
+		recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	})
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/augustoroman/hashex/task"
 )
 
 // EndPointStatsTracker tracks the performance of one or more http.HandlerFuncs.
@@ -14,52 +19,222 @@ import (
 // collecter and return the stats via an accessor, and define the handler
 // separately. This would be nice if we wanted to use the stats more generally.
 type EndPointStatsTracker struct {
-	// TODO(aroman) this type would be more useful if this was a
-	// map[string]callStats and Track took a string identifier:
-	//   Track(name string, f http.HandlerFunc) http.HandlerFunc
-	// and then ServeHTTP would provide metrics on several endpoints.
-	stats callStats
-	mutex sync.Mutex
+	endpoints map[string]*endpointStats // by the name given to Track
+	mutex     sync.Mutex
+
+	// RecoverPanics makes tracked handlers that panic respond with a 500
+	// instead of propagating the panic to the http.Server, which would
+	// otherwise log it and abruptly drop the connection. Either way, the call
+	// is counted as a 5xx.
+	RecoverPanics bool
+
+	// AutoResetInterval, if positive, makes RunAutoReset reset the stats this
+	// often, so that they reflect recent behavior rather than the whole
+	// lifetime of the server. That's cruder than a rolling window, but often
+	// good enough.
+	AutoResetInterval time.Duration
+
+	// RecentWindow, if positive, makes the stats also cover just the calls
+	// in the last RecentWindow (e.g. the last minute), reported as
+	// recent_total and recent_average. All-time averages move more and more
+	// slowly as calls accumulate, which hides recent regressions. It must not
+	// be changed after the first call is tracked.
+	RecentWindow time.Duration
+}
+
+// endpointStats are the collected statistics for one tracked endpoint.
+type endpointStats struct {
+	calls callStats
+	// Errors often return much faster than successful calls, which skews the
+	// overall average, so also keep stats by status class ("2xx", "4xx", ...).
+	byStatus map[string]callStats
+	recent   recentCalls // only used with RecentWindow
 }
 
 // Track wraps an http.HandlerFunc to provide a HandlerFunc that tracks the
-// performance of that func.
-func (e *EndPointStatsTracker) Track(h http.HandlerFunc) http.HandlerFunc {
+// performance of that func. The stats are reported under the given name, and
+// several handlers may share a name to be tracked together.
+func (e *EndPointStatsTracker) Track(name string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		h(w, r)
-		elapsed := time.Since(start)
+		start := time_Now() // indirect so that tests can control the durations
+		rec := &statusRecorder{ResponseWriter: w}
+		// Record the call even if the handler panics, otherwise the stats
+		// would quietly miss exactly the calls that are most interesting.
+		defer func() {
+			p := recover()
+			status := rec.Status()
+			if p != nil && rec.status == 0 {
+				status = http.StatusInternalServerError
+			}
+			e.record(name, time_Now().Sub(start), status)
 
-		e.mutex.Lock()
-		e.stats.Add(elapsed)
-		e.mutex.Unlock()
+			if p == nil {
+				return
+			}
+			// ErrAbortHandler is the sanctioned way to abort a response, so
+			// it's never recovered.
+			if !e.RecoverPanics || p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("ERROR: Panic serving %s %s: %v", r.Method, r.URL.Path, p)
+			if rec.status == 0 {
+				http.Error(w, "Sorry, something went wrong.", http.StatusInternalServerError)
+			}
+		}()
+		h(rec, r)
 	}
 }
 
-// ServeHTTP responds to the http request with the collected statistics.
-func (e *EndPointStatsTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// record adds a call to the stats of the named endpoint.
+func (e *EndPointStatsTracker) record(name string, elapsed time.Duration, status int) {
+	class := fmt.Sprintf("%dxx", status/100)
+
 	e.mutex.Lock()
-	stats := e.stats
-	e.mutex.Unlock()
-
-	// Reformat the stats to correspond to the desired API.
-	apiStats := struct {
-		Total       int `json:"total"`
-		AverageUSec int `json:"average"`
-	}{
-		Total:       stats.NumCalls,
-		AverageUSec: int(stats.Average() / time.Microsecond),
+	defer e.mutex.Unlock()
+	if e.endpoints == nil {
+		e.endpoints = map[string]*endpointStats{}
+	}
+	stats := e.endpoints[name]
+	if stats == nil {
+		stats = &endpointStats{byStatus: map[string]callStats{}}
+		e.endpoints[name] = stats
+	}
+	stats.calls.Add(elapsed)
+	if e.RecentWindow > 0 {
+		stats.recent.Add(time_Now(), e.RecentWindow, elapsed)
 	}
+	classStats := stats.byStatus[class]
+	classStats.Add(elapsed)
+	stats.byStatus[class] = classStats
+}
+
+// StatsSnapshot is a point-in-time copy of the collected statistics for an
+// endpoint, formatted to correspond to the desired API.
+type StatsSnapshot struct {
+	CallsSnapshot
+	ByStatus map[string]CallsSnapshot `json:"by_status,omitempty"`
+	// ErrorRate is the fraction of calls that failed with a 5xx. Client
+	// errors (4xx) are usually the client's problem, not ours, so they're
+	// only reported in ByStatus.
+	ErrorRate float64 `json:"error_rate"`
+	// The number and average duration of the calls in the RecentWindow. These
+	// are always zero without a RecentWindow.
+	RecentTotal       int `json:"recent_total"`
+	RecentAverageUSec int `json:"recent_average"`
+}
+
+// CallsSnapshot summarizes a set of calls.
+type CallsSnapshot struct {
+	Total       int `json:"total"`
+	AverageUSec int `json:"average"`
+	// Percentiles are approximate, see task.LatencyHistogram.
+	P50USec int `json:"p50"`
+	P90USec int `json:"p90"`
+	P99USec int `json:"p99"`
+}
+
+// Snapshot returns the current statistics, keyed by endpoint name. Endpoints
+// that haven't been called yet are missing.
+func (e *EndPointStatsTracker) Snapshot() map[string]StatsSnapshot {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.snapshotLocked()
+}
+
+// snapshotLocked must be called with the mutex held.
+func (e *EndPointStatsTracker) snapshotLocked() map[string]StatsSnapshot {
+	snapshots := make(map[string]StatsSnapshot, len(e.endpoints))
+	now := time_Now()
+	for name, stats := range e.endpoints {
+		snapshot := StatsSnapshot{
+			CallsSnapshot: stats.calls.Snapshot(),
+			ByStatus:      map[string]CallsSnapshot{},
+		}
+		for class, classStats := range stats.byStatus {
+			snapshot.ByStatus[class] = classStats.Snapshot()
+		}
+		if e.RecentWindow > 0 {
+			recent := stats.recent.Since(now, e.RecentWindow)
+			snapshot.RecentTotal = recent.NumCalls
+			snapshot.RecentAverageUSec = int(recent.Average() / time.Microsecond)
+		}
+		if stats.calls.NumCalls > 0 {
+			snapshot.ErrorRate = float64(stats.byStatus["5xx"].NumCalls) / float64(stats.calls.NumCalls)
+		}
+		snapshots[name] = snapshot
+	}
+	return snapshots
+}
+
+// Reset clears the collected statistics, returning what they were just before.
+func (e *EndPointStatsTracker) Reset() map[string]StatsSnapshot {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	snapshots := e.snapshotLocked()
+	e.endpoints = nil
+	return snapshots
+}
+
+// RunAutoReset resets the stats every AutoResetInterval, logging a summary of
+// each period, until the context is done. It returns immediately if
+// AutoResetInterval isn't set.
+func (e *EndPointStatsTracker) RunAutoReset(ctx context.Context) {
+	if e.AutoResetInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(e.AutoResetInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for name, s := range e.Reset() {
+				log.Printf("Stats for %s over the last %v: %d calls, average %dus",
+					name, e.AutoResetInterval, s.Total, s.AverageUSec)
+			}
+		}
+	}
+}
+
+// ServeHTTP responds to the http request with the collected statistics, as a
+// JSON object keyed by endpoint name.
+func (e *EndPointStatsTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// We don't care about encoding errors -- the only possible errors here are
 	// write errors if the client disconnects early.
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(apiStats)
+	_ = json.NewEncoder(w).Encode(e.Snapshot())
+}
+
+// statsHandler serves the endpoint statistics like ServeHTTP, with the
+// "bytes_hashed" total of the API alongside the endpoints. Like the status
+// page, that covers every listener sharing the API's Bytes. It's a running
+// total, so ServeReset leaves it alone.
+func statsHandler(perf *EndPointStatsTracker, hashApi *HashApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := map[string]interface{}{"bytes_hashed": hashApi.BytesHashed()}
+		for name, s := range perf.Snapshot() {
+			stats[name] = s
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// ServeReset resets the stats and responds with what they were just before,
+// in the same format as ServeHTTP. That's handy for benchmarking: reset, run
+// the benchmark, and reset again to get the results.
+func (e *EndPointStatsTracker) ServeReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(e.Reset())
 }
 
 // callStats represents the collected statistics for a particular endpoint.
 type callStats struct {
 	NumCalls int
 	Elapsed  time.Duration
+	// The average hides tail latency, so also keep a histogram.
+	Latency task.LatencyHistogram
 }
 
 // Average returns the average duration per call, or 0 if there is no data yet.
@@ -70,8 +245,59 @@ func (c callStats) Average() time.Duration {
 	return c.Elapsed / time.Duration(c.NumCalls)
 }
 
+// Snapshot reformats the stats to correspond to the desired API.
+func (c callStats) Snapshot() CallsSnapshot {
+	return CallsSnapshot{
+		Total:       c.NumCalls,
+		AverageUSec: int(c.Average() / time.Microsecond),
+		P50USec:     int(c.Latency.Percentile(50) / time.Microsecond),
+		P90USec:     int(c.Latency.Percentile(90) / time.Microsecond),
+		P99USec:     int(c.Latency.Percentile(99) / time.Microsecond),
+	}
+}
+
 // Add accumulates the duration of a new call into this object.
 func (c *callStats) Add(e time.Duration) {
 	c.NumCalls++
 	c.Elapsed += e
+	c.Latency.Add(e)
+}
+
+// recentCalls counts calls in a sliding window of time. The window is split
+// into a ring of buckets, each covering a slice of it, and the oldest bucket is
+// reused as time moves on. That way the memory use is fixed, and the window
+// slides in steps of a bucket's width.
+type recentCalls [recentBuckets]struct {
+	start    time.Time
+	numCalls int
+	elapsed  time.Duration
+}
+
+const recentBuckets = 10
+
+// Add counts a call that took e and finished at now.
+func (r *recentCalls) Add(now time.Time, window, e time.Duration) {
+	// Absurdly short windows still need buckets at least 1ns wide, otherwise
+	// there's nothing to divide by.
+	width := max(window/recentBuckets, 1)
+	start := now.Truncate(width)
+	b := &r[int(start.UnixNano()/int64(width))%recentBuckets]
+	if !b.start.Equal(start) {
+		// Whatever was here is from an earlier lap around the ring.
+		b.start, b.numCalls, b.elapsed = start, 0, 0
+	}
+	b.numCalls++
+	b.elapsed += e
+}
+
+// Since returns the totals of the buckets that are still within the window.
+func (r *recentCalls) Since(now time.Time, window time.Duration) callStats {
+	var total callStats
+	for _, b := range r {
+		if b.numCalls > 0 && now.Sub(b.start) < window {
+			total.NumCalls += b.numCalls
+			total.Elapsed += b.elapsed
+		}
+	}
+	return total
 }
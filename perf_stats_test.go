@@ -1,14 +1,362 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/augustoroman/hashex/task"
+)
 
 func TestEndPointStatsTracker(t *testing.T) {
-	// things to test:
-	// - that it's totally safe when accessed concurrently (run with go test -race too)
-	//   (both for the wrapped Track handler and the ServeHTTP call)
-	// - use a bunch of channels in the handlers to maximize contention
-	//     (e.g. see https://godoc.org/github.com/fluxio/sync_testing that I wrote at Flux)
-	// - check that there's no divide-by-0
-	// - replace time_Since and time_Now calls with indirect version to validate
-	//   time operations... or use a fake clock, or do some heuristics of dt > X.
+	t.Run("measures the time spent in the handler", func(t *testing.T) {
+		defer func() { time_Now = time.Now }()
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		time_Now = func() time.Time { return now }
+
+		var perf EndPointStatsTracker
+		for _, d := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 60 * time.Millisecond} {
+			handler := perf.Track("test", func(w http.ResponseWriter, r *http.Request) {
+				now = now.Add(d)
+			})
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		snapshot := perf.Snapshot()["test"]
+		if snapshot.Total != 3 || snapshot.AverageUSec != 30000 {
+			t.Errorf("Wrong stats: %+v", snapshot)
+		}
+	})
+	t.Run("doesn't divide by zero without calls", func(t *testing.T) {
+		var perf EndPointStatsTracker
+		if snapshot := perf.Snapshot(); len(snapshot) != 0 {
+			t.Errorf("Stats without any calls: %+v", snapshot)
+		}
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil)
+		perf.ServeHTTP(w, r)
+		if w.Body.String() != "{}\n" {
+			t.Errorf("Wrong output: %#q", w.Body.String())
+		}
+		var stats callStats
+		if avg := stats.Average(); avg != 0 {
+			t.Errorf("Wrong average: %v", avg)
+		}
+		if snapshot := stats.Snapshot(); snapshot != (CallsSnapshot{}) {
+			t.Errorf("Wrong snapshot: %+v", snapshot)
+		}
+	})
+	t.Run("is safe for concurrent use", func(t *testing.T) {
+		// Run with -race. The handlers all block until released at once, to
+		// maximize the contention between recording calls and reporting them.
+		perf := EndPointStatsTracker{RecentWindow: time.Minute}
+		release := make(chan struct{})
+		handler := perf.Track("test", func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		})
+		const N = 50
+		var wg sync.WaitGroup
+		for i := 0; i < N; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}()
+			go func() {
+				defer wg.Done()
+				<-release
+				perf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil))
+				perf.ServePrometheus(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+			}()
+		}
+		close(release)
+		wg.Wait()
+		if snapshot := perf.Snapshot()["test"]; snapshot.Total != N || snapshot.RecentTotal != N {
+			t.Errorf("Wrong stats: %+v", snapshot)
+		}
+	})
+}
+
+func TestNamedEndpoints(t *testing.T) {
+	var perf EndPointStatsTracker
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	a, b := perf.Track("a", ok), perf.Track("b", ok)
+	alsoA := perf.Track("a", ok)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		call := func(h http.HandlerFunc) {
+			defer wg.Done()
+			h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		go call(a)
+		go call(b)
+		go call(alsoA)
+	}
+	wg.Wait()
+
+	snapshot := perf.Snapshot()
+	if len(snapshot) != 2 || snapshot["a"].Total != 20 || snapshot["b"].Total != 10 {
+		t.Errorf("Wrong stats: %+v", snapshot)
+	}
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil)
+	perf.ServeHTTP(w, r)
+	var reported map[string]struct{ Total int }
+	if err := json.Unmarshal(w.Body.Bytes(), &reported); err != nil {
+		t.Fatal(err)
+	}
+	if reported["a"].Total != 20 || reported["b"].Total != 10 {
+		t.Errorf("Wrong stats reported: %s", w.Body.String())
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	var perf EndPointStatsTracker
+	perf.record("hash", 10*time.Millisecond, 202)
+	api := &HashApi{Bytes: &ByteBudget{}}
+	api.Bytes.Spend(1234, 0, 0)
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil)
+	statsHandler(&perf, api)(w, r)
+	var reported struct {
+		Hash        struct{ Total int } `json:"hash"`
+		BytesHashed int64               `json:"bytes_hashed"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reported); err != nil {
+		t.Fatal(err)
+	}
+	if reported.Hash.Total != 1 || reported.BytesHashed != 1234 {
+		t.Errorf("Wrong stats reported: %s", w.Body.String())
+	}
+}
+
+func TestStatusClassStats(t *testing.T) {
+	var perf EndPointStatsTracker
+	respond := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if code != 0 {
+				w.WriteHeader(code)
+			}
+		}
+	}
+	for _, code := range []int{0, 200, 202, 400, 404, 404, 500} {
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		perf.Track("test", respond(code))(w, r)
+	}
+
+	snapshot := perf.Snapshot()["test"]
+	if snapshot.Total != 7 {
+		t.Errorf("Wrong total: %d", snapshot.Total)
+	}
+	counts := map[string]int{}
+	for class, stats := range snapshot.ByStatus {
+		counts[class] = stats.Total
+	}
+	expected := map[string]int{"2xx": 3, "4xx": 3, "5xx": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Wrong counts by status:\nHave: %v\nWant: %v", counts, expected)
+	}
+	if snapshot.ErrorRate != 1.0/7 {
+		t.Errorf("Wrong error rate: %v", snapshot.ErrorRate)
+	}
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil)
+	perf.ServeHTTP(w, r)
+	var reported map[string]struct {
+		ByStatus  map[string]struct{ Total int } `json:"by_status"`
+		ErrorRate float64                        `json:"error_rate"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reported); err != nil {
+		t.Fatal(err)
+	}
+	if test := reported["test"]; test.ByStatus["4xx"].Total != 3 || test.ErrorRate != 1.0/7 {
+		t.Errorf("Wrong stats reported: %s", w.Body.String())
+	}
+}
+
+func TestTrackPanics(t *testing.T) {
+	panicky := func(w http.ResponseWriter, r *http.Request) { panic("boom") }
+
+	t.Run("records the call and re-panics by default", func(t *testing.T) {
+		var perf EndPointStatsTracker
+		func() {
+			defer func() {
+				if p := recover(); p != "boom" {
+					t.Errorf("Expected the panic to propagate, got %v", p)
+				}
+			}()
+			w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+			perf.Track("test", panicky)(w, r)
+		}()
+		snapshot := perf.Snapshot()["test"]
+		if snapshot.Total != 1 || snapshot.ByStatus["5xx"].Total != 1 {
+			t.Errorf("Panicking call wasn't recorded as a 5xx: %+v", snapshot)
+		}
+	})
+	t.Run("can recover instead", func(t *testing.T) {
+		perf := EndPointStatsTracker{RecoverPanics: true}
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		perf.Track("test", panicky)(w, r)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Wrong status: %d", w.Code)
+		}
+		snapshot := perf.Snapshot()["test"]
+		if snapshot.Total != 1 || snapshot.ByStatus["5xx"].Total != 1 {
+			t.Errorf("Panicking call wasn't recorded as a 5xx: %+v", snapshot)
+		}
+	})
+}
+
+func TestAutoReset(t *testing.T) {
+	perf := EndPointStatsTracker{AutoResetInterval: 10 * time.Millisecond}
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+	perf.Track("test", func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	if total := perf.Snapshot()["test"].Total; total != 1 {
+		t.Fatalf("Wrong total: %d", total)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		perf.RunAutoReset(ctx)
+		close(stopped)
+	}()
+	for start := time.Now(); len(perf.Snapshot()) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Stats were never reset")
+		}
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("RunAutoReset didn't stop")
+	}
+}
+
+func TestRecentWindow(t *testing.T) {
+	defer func() { time_Now = time.Now }()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	time_Now = func() time.Time { return now }
+
+	perf := EndPointStatsTracker{RecentWindow: time.Minute}
+	for _, elapsed := range []time.Duration{time.Millisecond, 3 * time.Millisecond} {
+		perf.record("test", elapsed, 200)
+	}
+	now = now.Add(30 * time.Second)
+	perf.record("test", 5*time.Millisecond, 200)
+
+	snapshot := perf.Snapshot()["test"]
+	if snapshot.RecentTotal != 3 || snapshot.RecentAverageUSec != 3000 {
+		t.Errorf("Wrong recent stats: %+v", snapshot)
+	}
+
+	// The first two calls age out.
+	now = now.Add(45 * time.Second)
+	snapshot = perf.Snapshot()["test"]
+	if snapshot.RecentTotal != 1 || snapshot.RecentAverageUSec != 5000 {
+		t.Errorf("Wrong recent stats: %+v", snapshot)
+	}
+	if snapshot.Total != 3 {
+		t.Errorf("All-time stats shouldn't age out: %+v", snapshot)
+	}
+
+	// Much later, a new call reuses the old buckets without counting them.
+	now = now.Add(time.Hour)
+	perf.record("test", 7*time.Millisecond, 200)
+	snapshot = perf.Snapshot()["test"]
+	if snapshot.RecentTotal != 1 || snapshot.RecentAverageUSec != 7000 {
+		t.Errorf("Wrong recent stats: %+v", snapshot)
+	}
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil)
+	perf.ServeHTTP(w, r)
+	var reported map[string]struct {
+		RecentTotal   int `json:"recent_total"`
+		RecentAverage int `json:"recent_average"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reported); err != nil {
+		t.Fatal(err)
+	}
+	if test := reported["test"]; test.RecentTotal != 1 || test.RecentAverage != 7000 {
+		t.Errorf("Wrong stats reported: %s", w.Body.String())
+	}
+}
+
+func TestRecentWindowTooShortToSplit(t *testing.T) {
+	// Less than a nanosecond per bucket mustn't divide by zero.
+	perf := EndPointStatsTracker{RecentWindow: recentBuckets - 1}
+	perf.record("test", time.Millisecond, 200)
+	if snapshot := perf.Snapshot()["test"]; snapshot.Total != 1 {
+		t.Errorf("Wrong stats: %+v", snapshot)
+	}
+}
+
+func TestServeReset(t *testing.T) {
+	var perf EndPointStatsTracker
+	mux := newMux(&HashApi{}, &perf, muxConfig{})
+	handler := perf.Track("test", func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 3; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/stats/reset", nil)
+	mux.ServeHTTP(w, r)
+	var before map[string]struct{ Total int }
+	if err := json.Unmarshal(w.Body.Bytes(), &before); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || before["test"].Total != 3 {
+		t.Errorf("Wrong pre-reset stats: %d %s", w.Code, w.Body.String())
+	}
+
+	w, r = httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil)
+	mux.ServeHTTP(w, r)
+	// The bytes hashed are a running total, see statsHandler.
+	if w.Body.String() != `{"bytes_hashed":0}`+"\n" {
+		t.Errorf("Stats weren't reset: %s", w.Body.String())
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	var stats callStats
+	// 1ms, 2ms, ..., 100ms
+	for i := 1; i <= 100; i++ {
+		stats.Add(time.Duration(i) * time.Millisecond)
+	}
+	snapshot := stats.Snapshot()
+	for _, check := range []struct {
+		name           string
+		actual, expect int
+	}{
+		{"p50", snapshot.P50USec, 50000},
+		{"p90", snapshot.P90USec, 90000},
+		{"p99", snapshot.P99USec, 99000},
+	} {
+		// Each bucket spans about 9%, and the upper bound is reported.
+		if check.actual < check.expect || float64(check.actual) > 1.1*float64(check.expect) {
+			t.Errorf("Wrong %s: %dus, expected about %dus", check.name, check.actual, check.expect)
+		}
+	}
+
+	t.Run("handles extremes", func(t *testing.T) {
+		var h task.LatencyHistogram
+		if p := h.Percentile(50); p != 0 {
+			t.Errorf("Wrong percentile without data: %v", p)
+		}
+		h.Add(0)
+		h.Add(100 * time.Hour)
+		if p := h.Percentile(50); p > 2*time.Microsecond {
+			t.Errorf("Wrong p50: %v", p)
+		}
+		if p := h.Percentile(100); p < time.Hour {
+			t.Errorf("Wrong p100: %v", p)
+		}
+	})
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/augustoroman/hashex/task"
+)
+
+// ServePrometheus responds with the collected statistics in the Prometheus
+// text exposition format, so that they can be scraped without a separate
+// exporter. It reports the hashex_requests_total counter by endpoint and
+// status class, and the hashex_request_duration_seconds summary by endpoint.
+//
+// Note that with AutoResetInterval the counters periodically drop back to
+// zero, which Prometheus treats as a counter reset.
+func (e *EndPointStatsTracker) ServePrometheus(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	names := make([]string, 0, len(e.endpoints))
+	endpoints := make(map[string]endpointStats, len(e.endpoints))
+	for name, stats := range e.endpoints {
+		names = append(names, name)
+		byStatus := make(map[string]callStats, len(stats.byStatus))
+		for class, classStats := range stats.byStatus {
+			byStatus[class] = classStats
+		}
+		endpoints[name] = endpointStats{calls: stats.calls, byStatus: byStatus}
+	}
+	e.mutex.Unlock()
+	// Stable output is nicer to read and to test.
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	io.WriteString(w, "# HELP hashex_requests_total Requests handled, by endpoint and status class.\n")
+	io.WriteString(w, "# TYPE hashex_requests_total counter\n")
+	for _, name := range names {
+		classes := make([]string, 0, len(endpoints[name].byStatus))
+		for class := range endpoints[name].byStatus {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "hashex_requests_total{endpoint=%s,status=%s} %d\n",
+				promLabel(name), promLabel(class), endpoints[name].byStatus[class].NumCalls)
+		}
+	}
+
+	io.WriteString(w, "# HELP hashex_request_duration_seconds Request latency, by endpoint.\n")
+	io.WriteString(w, "# TYPE hashex_request_duration_seconds summary\n")
+	for _, name := range names {
+		calls := endpoints[name].calls
+		for _, q := range promQuantiles {
+			fmt.Fprintf(w, "hashex_request_duration_seconds{endpoint=%s,quantile=%q} %g\n",
+				promLabel(name), q.label, calls.Latency.Percentile(q.percentile).Seconds())
+		}
+		fmt.Fprintf(w, "hashex_request_duration_seconds_sum{endpoint=%s} %g\n",
+			promLabel(name), calls.Elapsed.Seconds())
+		fmt.Fprintf(w, "hashex_request_duration_seconds_count{endpoint=%s} %d\n",
+			promLabel(name), calls.NumCalls)
+	}
+}
+
+// prometheusHandler serves the endpoint statistics from ServePrometheus
+// together with the timings of the API's tasks, see writeTaskStats, and the
+// hashex_bytes_hashed_total counter. The byte count covers every listener
+// sharing the API's Bytes.
+func prometheusHandler(perf *EndPointStatsTracker, hashApi *HashApi) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		perf.ServePrometheus(w, r)
+		writeTaskStats(w, hashApi.Tasks.RunStats(), hashApi.Tasks.QueueStats())
+		io.WriteString(w, "# HELP hashex_bytes_hashed_total Total size of the inputs accepted for hashing.\n")
+		io.WriteString(w, "# TYPE hashex_bytes_hashed_total counter\n")
+		fmt.Fprintf(w, "hashex_bytes_hashed_total %d\n", hashApi.BytesHashed())
+	}
+}
+
+// writeTaskStats reports the hashex_task_duration_seconds summary by task
+// type and the hashex_task_queue_wait_seconds summary. Unlike the request
+// latency, the duration only covers the time spent running, not waiting for a
+// turn (which is the queue wait) or for the result to be fetched.
+func writeTaskStats(w io.Writer, stats map[string]task.RunStats, queue task.RunStats) {
+	types := make([]string, 0, len(stats))
+	for typ := range stats {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	io.WriteString(w, "# HELP hashex_task_duration_seconds Task run time, by task type.\n")
+	io.WriteString(w, "# TYPE hashex_task_duration_seconds summary\n")
+	for _, typ := range types {
+		writeSummary(w, "hashex_task_duration_seconds", "type="+promLabel(typ)+",", stats[typ])
+	}
+
+	io.WriteString(w, "# HELP hashex_task_queue_wait_seconds Time that tasks waited for a turn to run.\n")
+	io.WriteString(w, "# TYPE hashex_task_queue_wait_seconds summary\n")
+	writeSummary(w, "hashex_task_queue_wait_seconds", "", queue)
+}
+
+// writeSummary writes the quantiles, sum and count of a summary. The labels
+// are either empty or end with a comma, so that the quantile can follow.
+func writeSummary(w io.Writer, name, labels string, s task.RunStats) {
+	for _, q := range promQuantiles {
+		fmt.Fprintf(w, "%s{%squantile=%q} %g\n",
+			name, labels, q.label, s.Latency.Percentile(q.percentile).Seconds())
+	}
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, s.Total.Seconds())
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, s.Count)
+}
+
+// promQuantiles are the quantiles reported for each summary.
+var promQuantiles = []struct {
+	label      string
+	percentile float64
+}{{"0.5", 50}, {"0.9", 90}, {"0.99", 99}}
+
+// promLabel quotes a label value for the Prometheus text format, which only
+// escapes backslashes, quotes and newlines.
+func promLabel(val string) string {
+	return `"` + promEscaper.Replace(val) + `"`
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
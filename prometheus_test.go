@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/augustoroman/hashex/task"
+)
+
+func TestServePrometheus(t *testing.T) {
+	var perf EndPointStatsTracker
+	perf.record("hash", 10*time.Millisecond, 202)
+	perf.record("hash", 30*time.Millisecond, 202)
+	perf.record("hash", time.Millisecond, 400)
+	perf.record(`we"ird`, time.Second, 200)
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil)
+	perf.ServePrometheus(w, r)
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Wrong content type: %s", ct)
+	}
+	lines := map[string]bool{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		lines[line] = true
+	}
+	for _, expected := range []string{
+		"# TYPE hashex_requests_total counter",
+		`hashex_requests_total{endpoint="hash",status="2xx"} 2`,
+		`hashex_requests_total{endpoint="hash",status="4xx"} 1`,
+		`hashex_requests_total{endpoint="we\"ird",status="2xx"} 1`,
+		"# TYPE hashex_request_duration_seconds summary",
+		`hashex_request_duration_seconds_sum{endpoint="hash"} 0.041`,
+		`hashex_request_duration_seconds_count{endpoint="hash"} 3`,
+		`hashex_request_duration_seconds_count{endpoint="we\"ird"} 1`,
+	} {
+		if !lines[expected] {
+			t.Errorf("Missing %#q in:\n%s", expected, w.Body.String())
+		}
+	}
+	for _, quantile := range []string{"0.5", "0.9", "0.99"} {
+		prefix := `hashex_request_duration_seconds{endpoint="hash",quantile="` + quantile + `"} `
+		if !strings.Contains(w.Body.String(), prefix) {
+			t.Errorf("Missing %s quantile in:\n%s", quantile, w.Body.String())
+		}
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	var perf EndPointStatsTracker
+	perf.record("hash", 10*time.Millisecond, 202)
+	api := &HashApi{Bytes: &ByteBudget{}}
+	api.Bytes.Spend(1234, 0, 0)
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil)
+	prometheusHandler(&perf, api)(w, r)
+
+	lines := map[string]bool{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		lines[line] = true
+	}
+	for _, expected := range []string{
+		`hashex_requests_total{endpoint="hash",status="2xx"} 1`,
+		"# TYPE hashex_task_duration_seconds summary",
+		"# TYPE hashex_bytes_hashed_total counter",
+		"hashex_bytes_hashed_total 1234",
+	} {
+		if !lines[expected] {
+			t.Errorf("Missing %#q in:\n%s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestWriteTaskStats(t *testing.T) {
+	stats := func(durations ...time.Duration) task.RunStats {
+		var s task.RunStats
+		for _, d := range durations {
+			s.Count++
+			s.Total += d
+			s.Latency.Add(d)
+		}
+		return s
+	}
+	var out strings.Builder
+	writeTaskStats(&out,
+		map[string]task.RunStats{"hash:sha512": stats(time.Millisecond, 2*time.Millisecond, time.Second)},
+		stats(0, 500*time.Millisecond))
+
+	lines := map[string]bool{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		lines[line] = true
+	}
+	for _, expected := range []string{
+		"# TYPE hashex_task_duration_seconds summary",
+		`hashex_task_duration_seconds_sum{type="hash:sha512"} 1.003`,
+		`hashex_task_duration_seconds_count{type="hash:sha512"} 3`,
+		"# TYPE hashex_task_queue_wait_seconds summary",
+		`hashex_task_queue_wait_seconds_sum 0.5`,
+		`hashex_task_queue_wait_seconds_count 2`,
+	} {
+		if !lines[expected] {
+			t.Errorf("Missing %#q in:\n%s", expected, out.String())
+		}
+	}
+	for _, quantile := range []string{"0.5", "0.9", "0.99"} {
+		for _, prefix := range []string{
+			`hashex_task_duration_seconds{type="hash:sha512",quantile="` + quantile + `"} `,
+			`hashex_task_queue_wait_seconds{quantile="` + quantile + `"} `,
+		} {
+			if !strings.Contains(out.String(), prefix) {
+				t.Errorf("Missing %s in:\n%s", prefix, out.String())
+			}
+		}
+	}
+}
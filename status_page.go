@@ -0,0 +1,57 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+//go:embed status.html
+var statusHtml string
+
+var statusTemplate = template.Must(template.New("status").Parse(statusHtml))
+
+// StatusPage serves a minimal, auto-refreshing HTML page that summarizes the
+// state of the server for humans glancing at it with a browser. Machines
+// should use /stats instead, which reports the same endpoint stats snapshot.
+type StatusPage struct {
+	Stats   *EndPointStatsTracker
+	Api     *HashApi
+	Started time.Time
+}
+
+// ServeHTTP renders the status page.
+func (s StatusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Registered on "/", which matches everything that isn't otherwise
+	// handled, so don't pretend that every random path is the status page.
+	if r.URL.Path != "/" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, "GET", "HEAD")
+		return
+	}
+
+	data := struct {
+		RefreshSec  int
+		Uptime      time.Duration
+		InFlight    int
+		BytesHashed int64
+		Stats       map[string]StatsSnapshot
+	}{
+		RefreshSec:  5,
+		Uptime:      time.Since(s.Started).Round(time.Second),
+		InFlight:    s.Api.Tasks.InFlight(),
+		BytesHashed: s.Api.BytesHashed(),
+		Stats:       s.Stats.Snapshot(),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		// Most likely the client went away, but it could be a template bug.
+		log.Printf("ERROR: Rendering status page: %v", err)
+	}
+}
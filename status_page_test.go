@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusPage(t *testing.T) {
+	t.Run("shows the current stats", func(t *testing.T) {
+		var perf EndPointStatsTracker
+		perf.record("hash", 3*time.Millisecond, 202)
+		perf.record("hash", 5*time.Millisecond, 202)
+		var api HashApi
+		api.Tasks.Start(blockingTask(make(chan struct{})))
+		api.Bytes = &ByteBudget{}
+		api.Bytes.Spend(1234, 0, 0)
+
+		page := StatusPage{&perf, &api, time.Now().Add(-90 * time.Second)}
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)
+		page.ServeHTTP(w, r)
+
+		if w.Code != 200 {
+			t.Fatalf("Wrong status: %d", w.Code)
+		}
+		body := w.Body.String()
+		for _, expected := range []string{
+			`<meta http-equiv="refresh" content="5">`,
+			"<th>Uptime</th><td>1m30s</td>",
+			"<th>Running tasks</th><td>1</td>",
+			"<th>Bytes hashed</th><td>1234</td>",
+			"<th>hash requests</th><td>2</td>",
+			"<th>Average hash time</th><td>4000 &micro;s</td>",
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("Missing %#q in:\n%s", expected, body)
+			}
+		}
+	})
+	t.Run("only serves the root", func(t *testing.T) {
+		page := StatusPage{&EndPointStatsTracker{}, &HashApi{}, time.Now()}
+		w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/favicon.ico", nil)
+		page.ServeHTTP(w, r)
+		if w.Code != 404 {
+			t.Errorf("Wrong status: %d", w.Code)
+		}
+	})
+	t.Run("only supports GET", func(t *testing.T) {
+		page := StatusPage{&EndPointStatsTracker{}, &HashApi{}, time.Now()}
+		w, r := httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil)
+		page.ServeHTTP(w, r)
+		if w.Code != 405 || w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("Wrong response: %d Allow=%q", w.Code, w.Header().Get("Allow"))
+		}
+	})
+}
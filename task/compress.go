@@ -0,0 +1,64 @@
+package task
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// compressedResult is a large string or []byte result that's stored gzipped
+// to save memory while it waits to be retrieved.
+type compressedResult struct {
+	data     []byte
+	isString bool
+}
+
+// compress returns a compressedResult version of result if it's a string or
+// []byte larger than threshold bytes and compressing it actually helps.
+// Otherwise the result is returned unchanged.
+func compress(result interface{}, threshold int) interface{} {
+	var raw []byte
+	var isString bool
+	switch res := result.(type) {
+	case string:
+		raw, isString = []byte(res), true
+	case []byte:
+		raw = res
+	default:
+		return result
+	}
+	if len(raw) <= threshold {
+		return result
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(raw) // Can't fail when writing to a bytes.Buffer.
+	gz.Close()
+	if buf.Len() >= len(raw) {
+		return result // Incompressible, don't bother.
+	}
+	// Copy out of the buffer so we don't hold onto its spare capacity.
+	return compressedResult{bytes.Clone(buf.Bytes()), isString}
+}
+
+// decompress reverses compress: compressed results are returned in their
+// original form and anything else is returned unchanged.
+func decompress(result interface{}) (interface{}, error) {
+	c, ok := result.(compressedResult)
+	if !ok {
+		return result, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(c.data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	if c.isString {
+		return string(raw), nil
+	}
+	return raw, nil
+}
@@ -0,0 +1,59 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+type resultTask struct{ result interface{} }
+
+func (r resultTask) Run() (interface{}, error) { return r.result, nil }
+
+func TestCompressAbove(t *testing.T) {
+	// Something large and reasonably compressible, like a typical report.
+	large := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 25000)
+
+	tm := Manager{CompressAbove: 1024, IdGenerator: SequentialIds()}
+	tm.Start(resultTask{large})
+	tm.Start(resultTask{[]byte(large)})
+	tm.Start(resultTask{"small"})
+	tm.Start(resultTask{42})
+	tm.Shutdown(context.Background()) // wait for them all to finish
+
+	t.Run("stores large results compressed", func(t *testing.T) {
+		for _, id := range []Id{"1", "2"} {
+			c, ok := tm.tasks[id].result.(compressedResult)
+			if !ok {
+				t.Fatalf("Result %s is not compressed: %T", id, tm.tasks[id].result)
+			}
+			savings := 1 - float64(len(c.data))/float64(len(large))
+			t.Logf("Result %s: %d bytes compressed to %d (%.1f%% savings)",
+				id, len(large), len(c.data), 100*savings)
+			if savings < 0.9 {
+				t.Errorf("Expected much better compression for result %s", id)
+			}
+		}
+	})
+	t.Run("leaves other results alone", func(t *testing.T) {
+		if res := tm.tasks["3"].result; res != "small" {
+			t.Errorf("Wrong stored result: %#v", res)
+		}
+		if res := tm.tasks["4"].result; res != 42 {
+			t.Errorf("Wrong stored result: %#v", res)
+		}
+	})
+	t.Run("returns the original results", func(t *testing.T) {
+		ctx := context.Background()
+		if res, err := tm.Wait(ctx, "1"); err != nil || res != large {
+			t.Errorf("Wrong string result (err=%v)", err)
+		}
+		if res, err := tm.Wait(ctx, "2"); err != nil || !bytes.Equal(res.([]byte), []byte(large)) {
+			t.Errorf("Wrong []byte result (err=%v)", err)
+		}
+		if res, err := tm.Wait(ctx, "3"); err != nil || res != "small" {
+			t.Errorf("Wrong small result: %#v (err=%v)", res, err)
+		}
+	})
+}
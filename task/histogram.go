@@ -0,0 +1,45 @@
+package task
+
+import (
+	"math"
+	"time"
+)
+
+// LatencyHistogram counts durations in logarithmic buckets, which keeps the
+// memory use fixed no matter how many are counted, while still giving
+// percentiles within about 10% of the real value. Each doubling of duration
+// is split into bucketsPerDoubling buckets, starting from 1us. Anything
+// beyond the last bucket (about 70 minutes) lands in it.
+type LatencyHistogram [32 * bucketsPerDoubling]int
+
+const bucketsPerDoubling = 8
+
+// Add counts a duration.
+func (h *LatencyHistogram) Add(d time.Duration) {
+	i := 0
+	if us := float64(d) / float64(time.Microsecond); us > 1 {
+		i = min(int(math.Log2(us)*bucketsPerDoubling), len(h)-1)
+	}
+	h[i]++
+}
+
+// Percentile returns the approximate duration that p percent of the counted
+// durations don't exceed, or 0 if nothing has been counted yet. The result is
+// the upper bound of the bucket that the percentile falls in.
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	total := 0
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(total)))
+	for i, n := range h {
+		if rank -= n; rank <= 0 {
+			upper := math.Exp2(float64(i+1) / bucketsPerDoubling)
+			return time.Duration(upper * float64(time.Microsecond))
+		}
+	}
+	return 0 // unreachable
+}
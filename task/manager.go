@@ -3,9 +3,18 @@ package task
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Interface is the common interface implemented for a task that can be managed
@@ -16,77 +25,779 @@ type Interface interface {
 	Run() (interface{}, error)
 }
 
+// ContextRunner may optionally be implemented by tasks that can be aborted.
+// If it is, the Manager calls RunContext instead of Run, and the context is
+// done when the task should stop, e.g. when its timeout expires or Shutdown
+// gives up waiting for it. The task should then return promptly, preferably
+// with the context's error.
+type ContextRunner interface {
+	RunContext(ctx context.Context) (interface{}, error)
+}
+
+// Typer may optionally be implemented by tasks to describe what kind of task
+// they are. Different kinds of tasks can have very different performance, so
+// the Manager keeps separate statistics for each type. Tasks that don't
+// implement Typer are identified by their Go type instead.
+type Typer interface {
+	Type() string
+}
+
+// TypeOf returns the type name used to segment statistics for the task.
+func TypeOf(task Interface) string {
+	if t, ok := task.(Typer); ok {
+		return t.Type()
+	}
+	return fmt.Sprintf("%T", task)
+}
+
+// RunStats are the collected run time statistics for a type of task. The same
+// statistics are also kept for the time that tasks wait for a turn to run,
+// see Manager.QueueStats.
+type RunStats struct {
+	Count int           // Number of completed runs.
+	Total time.Duration // Cumulative run time.
+	Max   time.Duration // Longest single run.
+	// The average hides the slow runs, so also keep a histogram for the
+	// percentiles.
+	Latency LatencyHistogram
+}
+
+// Average returns the average run time, or 0 if there is no data yet.
+func (r RunStats) Average() time.Duration {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Total / time.Duration(r.Count)
+}
+
+// add counts a run that took elapsed.
+func (r *RunStats) add(elapsed time.Duration) {
+	r.Count++
+	r.Total += elapsed
+	r.Max = max(r.Max, elapsed)
+	r.Latency.Add(elapsed)
+}
+
+// TaskFunc runs a task, see Interface.
+type TaskFunc func() (interface{}, error)
+
+// Middleware wraps the execution of a task with cross-cutting logic such as
+// timing, logging or panic recovery. It must call next to actually run the
+// task, and may inspect or replace the outputs.
+type Middleware func(next TaskFunc) TaskFunc
+
 // Id identifies a task to a manager.
 type Id string
 
-// Manager keeps track of a set of tasks. Currently, it keeps tasks forever but
-// it should have a way of expiring tasks.
+// TaskStatus is the lifecycle state of a task.
+type TaskStatus int
+
+const (
+	Pending TaskStatus = iota // Started, but not running yet.
+	Running                   // Currently running.
+	Done                      // Completed successfully.
+	Failed                    // Completed with an error.
+)
+
+func (s TaskStatus) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Running:
+		return "running"
+	case Done:
+		return "done"
+	case Failed:
+		return "failed"
+	}
+	return "TaskStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// MarshalText encodes the status as its name, e.g. for JSON.
+func (s TaskStatus) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// UnmarshalText parses the status names from MarshalText.
+func (s *TaskStatus) UnmarshalText(text []byte) error {
+	for _, status := range []TaskStatus{Pending, Running, Done, Failed} {
+		if string(text) == status.String() {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown task status %q", text)
+}
+
+// Manager keeps track of a set of tasks. By default, it keeps tasks forever,
+// see TTL.
+//
+// TODO(aroman) If retained results are ever also capped by count, the cap
+// needs a minimum retention floor: a result younger than that must never be
+// evicted, even if it means temporarily exceeding the cap. Otherwise bursty
+// load can evict a result before its submitter fetches it. The TTL doesn't
+// have this problem since it's a floor by itself.
 type Manager struct {
-	mutex    sync.Mutex
-	tasks    map[Id]*taskOutput
-	stopping bool
+	// OnStateChange, if non-nil, is called each time a task transitions from
+	// one status to another. It's called from the task's goroutine without
+	// holding any locks, so it must be safe for concurrent use. This is mostly
+	// intended for tests that need to know exactly when a task is running or
+	// done rather than guessing with sleeps.
+	OnStateChange func(id Id, from, to TaskStatus)
+
+	// OnComplete, if non-nil, is called with the outputs of each task once it
+	// completes, after any waiters have been released. Like OnStateChange,
+	// it's called from the task's goroutine without holding any locks. It's
+	// meant for integrations such as webhooks, so Shutdown waits for it too,
+	// and a panic in it is logged rather than crashing the server.
+	OnComplete func(id Id, result interface{}, err error)
+
+	// CompressAbove, if positive, makes the Manager store string and []byte
+	// results larger than this many bytes gzipped, transparently
+	// decompressing them when they're retrieved. Small results aren't worth
+	// the overhead.
+	CompressAbove int
+
+	// TTL, if positive, is how long a completed task is kept after it
+	// completes. After that, it's as if the task never existed: Info and Wait
+	// return ErrNoSuchTask. Expired tasks are swept lazily as the Manager is
+	// used rather than by a background goroutine, so there's nothing to stop.
+	TTL time.Duration
+
+	// IdGenerator, if non-nil, generates the ids for new tasks instead of
+	// RandomId. It's called with the Manager's lock held, and ids that are
+	// already in use are skipped. Tests may want SequentialIds.
+	IdGenerator func() Id
+	// IdPrefix is prepended to the generated ids, e.g. "hash-" so that ids are
+	// self-describing in logs when several services share them. The prefix is
+	// just part of the id: lookups need the whole thing. Use IdGenerator to
+	// change the rest of the format.
+	IdPrefix string
+
+	// MaxConcurrent, if positive, limits how many tasks run at once. Further
+	// tasks wait in the Pending state for a turn, in no particular order. It
+	// must not be changed after the first task is started.
+	MaxConcurrent int
+	// MaxQueued, if positive, limits how many tasks can be waiting for a turn
+	// when MaxConcurrent is set. Beyond that, Start fails with ErrQueueFull
+	// rather than letting the backlog grow without bound.
+	MaxQueued int
+
+	// Store, if non-nil, persists the outputs of completed tasks, so that they
+	// can still be retrieved after a restart (or from another Manager that
+	// shares the Store). Tasks that aren't in memory are loaded from the Store
+	// when they're looked up. See DirStore and RedisStore.
+	Store Store
+
+	// Vars, if non-nil, is where the Manager keeps running counts of the tasks
+	// that it has "started", that are "running", and that have "completed" or
+	// "failed". Publish it with expvar.NewMap to monitor those. Several
+	// Managers can share it to report their combined counts.
+	Vars *expvar.Map
+
+	mutex       sync.Mutex
+	middlewares []Middleware
+	tasks       map[Id]*taskOutput
+	keys        map[string]Id // see StartOnce
+	nextSweep   time.Time     // when to next look for expired tasks
+	inFlight    int           // number of tasks that haven't completed yet
+	slots       chan struct{} // semaphore for MaxConcurrent
+	ctx         context.Context
+	cancelAll   context.CancelFunc // cancels ctx, which all tasks run under
+	stopping    bool
+	stopped     chan struct{} // closed once stopping, to stop retries
+	runStats    map[string]RunStats
+	metrics     ManagerMetrics
+	// The time that tasks spent waiting for a turn and running, kept
+	// separately so it's clear whether latency comes from queueing or from
+	// slow tasks. See Metrics and QueueStats.
+	queueStats RunStats
+	runTime    time.Duration
+	// The number of finished tasks that actually ran, which is fewer than
+	// Completed+Failed when queued tasks are cancelled before their turn.
+	runs int64
 
 	running sync.WaitGroup
 }
 type taskOutput struct {
+	task Interface
+	typ  string // see TypeOf
+	key  string // see StartOnce
+
+	// These are guarded by Manager.mutex.
+	status                     TaskStatus
+	created, started, finished time.Time
+
+	cancel context.CancelFunc // aborts the task, see ContextRunner
 	done   chan struct{}
 	result interface{}
 	err    error
 }
 
+// Same as in the main package: allow tests to control the clock.
+var time_Now = time.Now
+
 var (
 	ErrShuttingDown = errors.New("shutting down: cannot start a new task")
 	ErrNoSuchTask   = errors.New("no such task")
+	ErrQueueFull    = errors.New("too many tasks waiting to run")
+	// ErrAbandoned is the error for tasks that Shutdown gave up waiting for.
+	ErrAbandoned = errors.New("shutting down: gave up waiting for the task")
 )
 
 // Start initiates the execution of the provided task and returns the id. If
-// Shutdown has been called, then this will return ErrShuttingDown.
+// Shutdown has been called, then this will return ErrShuttingDown. If the
+// task would have to wait behind more than MaxQueued others, then this will
+// return ErrQueueFull.
 func (tm *Manager) Start(task Interface) (Id, error) {
+	return tm.StartWithTimeout(task, 0)
+}
+
+// StartWithTimeout is like Start, but the task fails with
+// context.DeadlineExceeded if it runs for longer than the timeout. A zero
+// timeout means no limit.
+//
+// Tasks that implement ContextRunner are asked to stop via their context.
+// Other tasks can't be stopped, so they're abandoned to finish in the
+// background, their eventual outputs are discarded, and Wait returns the
+// error as soon as the timeout expires.
+func (tm *Manager) StartWithTimeout(task Interface, timeout time.Duration) (Id, error) {
+	return tm.start("", task, timeout, RetryPolicy{})
+}
+
+// RetryPolicy says how to retry tasks that fail, see StartWithRetry.
+type RetryPolicy struct {
+	// MaxAttempts is the most times that the task is run, including the first
+	// time. Zero or one means not to retry at all.
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry. It doubles for each
+	// retry after that.
+	Backoff time.Duration
+}
+
+// StartWithRetry is like Start, but if the task fails, it's run again as the
+// policy allows. Only the outputs of the final attempt are recorded: Wait sees
+// the first success or the last failure. Once Shutdown is called, failed tasks
+// aren't retried anymore.
+func (tm *Manager) StartWithRetry(task Interface, retry RetryPolicy) (Id, error) {
+	return tm.start("", task, 0, retry)
+}
+
+// StartOnce is like Start, but starts at most one task per key: if a task was
+// already started with the key and is still around (see TTL), then its id is
+// returned instead. That lets clients retry starting a task, e.g. with an
+// Idempotency-Key header, without ending up with duplicates. An empty key is
+// the same as Start.
+//
+// The keys are shared by all clients, so they should be unique, e.g. UUIDs.
+// They're only kept in memory, even with a Store.
+func (tm *Manager) StartOnce(key string, task Interface) (Id, error) {
+	return tm.start(key, task, 0, RetryPolicy{})
+}
+
+func (tm *Manager) start(key string, task Interface, timeout time.Duration, retry RetryPolicy) (Id, error) {
 	tm.mutex.Lock()
+	if id, ok := tm.keys[key]; ok && tm.lookup(id) != nil {
+		// Already started. Even if we're shutting down or too busy now, the
+		// original request was accepted, so this one is too.
+		tm.mutex.Unlock()
+		return id, nil
+	}
 	if tm.stopping {
 		tm.mutex.Unlock()
 		return "", ErrShuttingDown
 	}
+	if tm.MaxConcurrent > 0 && tm.MaxQueued > 0 && tm.inFlight >= tm.MaxConcurrent+tm.MaxQueued {
+		tm.mutex.Unlock()
+		return "", ErrQueueFull
+	}
+	if tm.MaxConcurrent > 0 && tm.slots == nil {
+		tm.slots = make(chan struct{}, tm.MaxConcurrent)
+	}
+	slots := tm.slots
+	if tm.ctx == nil {
+		tm.ctx, tm.cancelAll = context.WithCancel(context.Background())
+		tm.stopped = make(chan struct{})
+	}
+	ctx, cancel := context.WithCancel(tm.ctx)
+	stopped := tm.stopped
 	if tm.tasks == nil {
 		tm.tasks = map[Id]*taskOutput{}
 	}
-	nextId := Id(strconv.Itoa(len(tm.tasks) + 1))
-	ti := &taskOutput{done: make(chan struct{})}
+	tm.sweep()
+	newId := tm.IdGenerator
+	if newId == nil {
+		newId = RandomId
+	}
+	nextId := Id(tm.IdPrefix) + newId()
+	for tm.idTaken(nextId) {
+		nextId = Id(tm.IdPrefix) + newId()
+	}
+	ti := &taskOutput{
+		task:    task,
+		typ:     TypeOf(task),
+		created: time_Now(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		key:     key,
+	}
 	tm.tasks[nextId] = ti
+	if key != "" {
+		if tm.keys == nil {
+			tm.keys = map[string]Id{}
+		}
+		tm.keys[key] = nextId
+	}
+	tm.inFlight++
+	tm.metrics.Queued++
+	tm.addVar("started", 1)
 	tm.running.Add(1)
+	middlewares := tm.middlewares
 	tm.mutex.Unlock()
 
 	go func() {
-		ti.result, ti.err = task.Run()
-		close(ti.done)
-		tm.running.Done()
+		defer cancel() // release the context's resources
+		// The task's Run calls, which outlive the task if it doesn't take a
+		// context and is abandoned, see runWithContext.
+		var runs sync.WaitGroup
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				// Abandoned Runs still take up a turn until they return,
+				// otherwise repeated timeouts would run more than
+				// MaxConcurrent at once.
+				defer func() {
+					runs.Wait()
+					<-slots
+				}()
+			case <-ctx.Done():
+				// Cancelled (or abandoned by Shutdown) while waiting for a
+				// turn, so it fails without ever running.
+				tm.finish(nextId, ti, nil, ctx.Err())
+				return
+			}
+		}
+		tm.setStatus(nextId, ti, Running)
+
+		// The timeout starts once the task is running, time spent waiting
+		// for a turn doesn't count against it.
+		if timeout > 0 {
+			var cancelTimeout context.CancelFunc
+			ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+			defer cancelTimeout()
+		}
+		run := runWithContext(ctx, task, &runs)
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			run = middlewares[i](run)
+		}
+		// The task itself is already covered, but the middlewares aren't.
+		run = recovered(run)
+		var result interface{}
+		var err error
+		if err = ctx.Err(); err == nil {
+			result, err = runWithRetries(ctx, stopped, run, retry)
+		}
+		tm.finish(nextId, ti, result, err)
 	}()
 
 	return nextId, nil
 }
 
+// Use adds middleware around the execution of every subsequently started task.
+// Middleware added first is outermost, so it sees the task's outputs after all
+// the later middleware have.
+func (tm *Manager) Use(mw Middleware) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.middlewares = append(tm.middlewares, mw)
+}
+
+// RandomId generates unguessable 128-bit ids. Sequential ids would leak how
+// many tasks have been run and let anyone fetch other clients' results just by
+// counting.
+func RandomId() Id {
+	var b [16]byte
+	rand.Read(b[:]) // never fails
+	return Id(base64.RawURLEncoding.EncodeToString(b[:]))
+}
+
+// SequentialIds returns an id generator that counts up from 1. That's handy
+// for tests, but see RandomId. The count never goes back down, so ids aren't
+// reused even once their tasks are deleted or expire.
+func SequentialIds() func() Id {
+	var n atomic.Int64
+	return func() Id { return Id(strconv.FormatInt(n.Add(1), 10)) }
+}
+
+// runWithRetries runs the task, and runs it again if it fails as the policy
+// allows. It gives up early if the context is done or once stopped is closed,
+// and returns the outputs of the last attempt either way.
+func runWithRetries(ctx context.Context, stopped <-chan struct{}, run TaskFunc, retry RetryPolicy) (interface{}, error) {
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		result, err := run()
+		if err == nil || attempt >= retry.MaxAttempts || ctx.Err() != nil {
+			return result, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-stopped:
+			timer.Stop()
+			return result, err
+		}
+		backoff *= 2
+	}
+}
+
+// runWithContext adapts the task to a TaskFunc that runs with the context.
+// Tasks that don't take a context are made to return as soon as the context
+// is done anyway, even though they keep running in the background. Those
+// background Runs are tracked by runs until they actually return.
+func runWithContext(ctx context.Context, task Interface, runs *sync.WaitGroup) TaskFunc {
+	if cr, ok := task.(ContextRunner); ok {
+		return recovered(func() (interface{}, error) { return cr.RunContext(ctx) })
+	}
+	run := recovered(task.Run)
+	if ctx.Done() == nil {
+		return run // can't be done, so don't bother
+	}
+	return func() (interface{}, error) {
+		type outputs struct {
+			result interface{}
+			err    error
+		}
+		finished := make(chan outputs, 1)
+		runs.Add(1)
+		go func() {
+			defer runs.Done()
+			result, err := run()
+			finished <- outputs{result, err}
+		}()
+		select {
+		case out := <-finished:
+			return out.result, out.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// recovered makes the TaskFunc fail instead of panicking, so that a bad task
+// can't crash the whole server.
+func recovered(run TaskFunc) TaskFunc {
+	return func() (result interface{}, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("ERROR: Task panicked: %v\n%s", p, debug.Stack())
+				result, err = nil, fmt.Errorf("task panicked: %v", p)
+			}
+		}()
+		return run()
+	}
+}
+
+// TaskInfo describes a task and its progress, but not its outputs.
+type TaskInfo struct {
+	Id       Id
+	Task     Interface // nil for restored tasks
+	Type     string    // see TypeOf
+	Status   TaskStatus
+	Created  time.Time // When the task was started.
+	Started  time.Time // When the task began running, zero until then.
+	Finished time.Time // When the task completed, zero until then.
+}
+
+// Info returns information about the task or ErrNoSuchTask.
+func (tm *Manager) Info(id Id) (TaskInfo, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	ti := tm.lookup(id)
+	if ti == nil {
+		return TaskInfo{}, ErrNoSuchTask
+	}
+	return ti.info(id), nil
+}
+
+// Delete forgets the task, cancelling it first if it hasn't completed yet
+// (see ContextRunner). Any Wait that's already in progress still returns
+// the task's outputs, but as far as anything else is concerned, the task
+// never existed. It returns ErrNoSuchTask if there's no such task.
+func (tm *Manager) Delete(id Id) error {
+	tm.mutex.Lock()
+	ti := tm.lookup(id)
+	tm.forget(id)
+	tm.mutex.Unlock()
+	if ti == nil {
+		return ErrNoSuchTask
+	}
+	if ti.cancel != nil { // restored tasks have nothing to cancel
+		ti.cancel()
+	}
+	return nil
+}
+
+// CancelAll cancels every task that hasn't completed yet, e.g. to shed load in
+// an emergency, and returns how many were cancelled. Their Waits return
+// context.Canceled. Running tasks that don't implement ContextRunner can't be
+// stopped, so they're left alone and counted as skipped. Queued tasks can
+// always be cancelled, since they haven't started yet.
+func (tm *Manager) CancelAll() (cancelled, skipped int) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	for _, ti := range tm.tasks {
+		if ti.cancel == nil || ti.status == Done || ti.status == Failed {
+			continue
+		}
+		if _, ok := ti.task.(ContextRunner); !ok && ti.status == Running {
+			skipped++
+			continue
+		}
+		ti.cancel()
+		cancelled++
+	}
+	return cancelled, skipped
+}
+
+// Status returns the current status of the task or ErrNoSuchTask. It's a
+// cheap way to check on a task without waiting for it.
+func (tm *Manager) Status(id Id) (TaskStatus, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	ti := tm.lookup(id)
+	if ti == nil {
+		return 0, ErrNoSuchTask
+	}
+	return ti.status, nil
+}
+
+// List returns information about all of the tasks, oldest first.
+func (tm *Manager) List() []TaskInfo {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.sweep()
+	now := time_Now()
+	infos := make([]TaskInfo, 0, len(tm.tasks))
+	for id, ti := range tm.tasks {
+		if !tm.expired(ti, now) {
+			infos = append(infos, ti.info(id))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].Created.Equal(infos[j].Created) {
+			return infos[i].Created.Before(infos[j].Created)
+		}
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
+
+// info must be called with the mutex held.
+func (ti *taskOutput) info(id Id) TaskInfo {
+	return TaskInfo{id, ti.task, ti.typ, ti.status, ti.created, ti.started, ti.finished}
+}
+
+// InFlight returns the number of tasks that have been started but haven't
+// completed yet.
+func (tm *Manager) InFlight() int {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.inFlight
+}
+
+// RunStats returns the run time statistics of the completed tasks, keyed by
+// task type (see TypeOf).
+func (tm *Manager) RunStats() map[string]RunStats {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	stats := make(map[string]RunStats, len(tm.runStats))
+	for typ, s := range tm.runStats {
+		stats[typ] = s
+	}
+	return stats
+}
+
+// QueueStats returns the statistics of how long tasks waited for a turn to run
+// (see MaxConcurrent), over all the tasks that have started running.
+func (tm *Manager) QueueStats() RunStats {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.queueStats
+}
+
+// ManagerMetrics are counts of the tasks in each state, to tell whether the
+// Manager is keeping up.
+type ManagerMetrics struct {
+	Queued  int64 `json:"queued"`  // Started, but waiting for a turn to run.
+	Running int64 `json:"running"` // Running right now.
+	// Completed and Failed are the total number of tasks that have finished
+	// (successfully or not), including any that have since been deleted or
+	// expired.
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+
+	// AvgQueueWait is the average time that tasks waited for a turn to run
+	// (see MaxConcurrent), over all the tasks that have started running.
+	// AvgRunTime is the average time that the finished tasks took to run,
+	// including retries. Both are zero until there's something to average.
+	AvgQueueWait time.Duration `json:"avg_queue_wait_ns"`
+	AvgRunTime   time.Duration `json:"avg_run_time_ns"`
+}
+
+// Metrics returns the current task counts and timings. They're updated along
+// with the task statuses, so they're always consistent with each other.
+func (tm *Manager) Metrics() ManagerMetrics {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	m := tm.metrics
+	m.AvgQueueWait = tm.queueStats.Average()
+	if tm.runs > 0 {
+		m.AvgRunTime = tm.runTime / time.Duration(tm.runs)
+	}
+	return m
+}
+
+// recordRun must be called with the mutex held.
+func (tm *Manager) recordRun(typ string, elapsed time.Duration) {
+	if tm.runStats == nil {
+		tm.runStats = map[string]RunStats{}
+	}
+	s := tm.runStats[typ]
+	s.add(elapsed)
+	tm.runStats[typ] = s
+}
+
+// setStatus transitions the task to the new status and notifies
+// OnStateChange. Completing the task (Done or Failed) also releases any
+// waiters, which happens before the notification so that by the time anyone
+// hears that a task is done, Wait will return immediately.
+func (tm *Manager) setStatus(id Id, ti *taskOutput, to TaskStatus) {
+	tm.mutex.Lock()
+	from := ti.status
+	ti.status = to
+	switch to {
+	case Running:
+		ti.started = time_Now()
+		tm.queueStats.add(ti.started.Sub(ti.created))
+		tm.metrics.Queued--
+		tm.metrics.Running++
+		tm.addVar("running", 1)
+	case Done, Failed:
+		ti.finished = time_Now()
+		tm.inFlight--
+		if from == Pending {
+			// It never got a turn to run.
+			tm.metrics.Queued--
+		} else {
+			tm.recordRun(ti.typ, ti.finished.Sub(ti.started))
+			tm.runTime += ti.finished.Sub(ti.started)
+			tm.runs++
+			tm.metrics.Running--
+			tm.addVar("running", -1)
+		}
+		if to == Done {
+			tm.metrics.Completed++
+			tm.addVar("completed", 1)
+		} else {
+			tm.metrics.Failed++
+			tm.addVar("failed", 1)
+		}
+	}
+	tm.mutex.Unlock()
+
+	if to == Done || to == Failed {
+		close(ti.done)
+	}
+	if tm.OnStateChange != nil {
+		tm.OnStateChange(id, from, to)
+	}
+}
+
+// finish records the outcome of the task and tells everyone waiting for it.
+func (tm *Manager) finish(id Id, ti *taskOutput, result interface{}, err error) {
+	if err != nil && errors.Is(err, context.Canceled) && tm.ctx.Err() != nil {
+		// Only Shutdown cancels the Manager's context, so say why.
+		err = ErrAbandoned
+	}
+	ti.result, ti.err = result, err
+	final := Done
+	if err != nil {
+		final = Failed
+	}
+	// Save it before anyone hears that it's done, so that whoever does can
+	// count on it being durable.
+	tm.save(id, ti, final, ti.result, ti.err)
+	if tm.CompressAbove > 0 {
+		ti.result = compress(ti.result, tm.CompressAbove)
+	}
+	tm.setStatus(id, ti, final)
+	tm.notifyComplete(id, ti)
+	tm.running.Done()
+}
+
+// notifyComplete calls OnComplete for the completed task, if set.
+func (tm *Manager) notifyComplete(id Id, ti *taskOutput) {
+	if tm.OnComplete == nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("ERROR: OnComplete panicked for task %s: %v", id, p)
+		}
+	}()
+	result, err := ti.outputs()
+	tm.OnComplete(id, result, err)
+}
+
+// addVar updates one of the counts in Vars, if set.
+func (tm *Manager) addVar(name string, delta int64) {
+	if tm.Vars != nil {
+		tm.Vars.Add(name, delta)
+	}
+}
+
 // Wait for the given task to be completed and return the result & error output
 // of the task. Once a task completes, subsequent calls to this function will
 // immediately return the outputs. If the provided context finishes before the
 // task has completed, then the context error (cancelled or timeout) will be
-// returned.
+// returned. That doesn't affect the task: it keeps running and a later call to
+// Wait will return its result.
+//
+// The task is looked up exactly once, when Wait is called. If the task is
+// subsequently removed from the manager, a Wait that's already in progress
+// still completes with the task's result, while new lookups of that id fail.
+//
+// If Shutdown gives up waiting for the task, then Wait returns ErrAbandoned
+// right away, even if the task ignores being cancelled, so that waiters can
+// tell their clients that the server is going away.
 //
 // NOTE(aroman) Probably this should only be allowed to be called once
 // succesfully (that is, not including the context timeout) and then expire the
 // task to prevent excessive memory growth.
 func (tm *Manager) Wait(ctx context.Context, id Id) (interface{}, error) {
 	tm.mutex.Lock()
-	ti := tm.tasks[id]
+	ti := tm.lookup(id)
+	var abandoned <-chan struct{} // stays nil (never ready) until a task starts
+	if tm.ctx != nil {
+		abandoned = tm.ctx.Done()
+	}
 	tm.mutex.Unlock()
 
 	if ti == nil {
 		return nil, ErrNoSuchTask
 	}
 
-	// TODO(aroman) Consider the semantics around shutting down. Currently this
-	// allows tasks to complete, but maybe that should be configurable? It's
-	// already possible to control depending on the underlying task
-	// implementation, but that puts more of a burden on the task writer.
+	// If the task is already done, always return the result even if the
+	// context is also done: select picks randomly among ready cases. This
+	// allows callers to check for a result without blocking by providing an
+	// expired context.
+	select {
+	case <-ti.done:
+		return ti.outputs()
+	default:
+	}
+
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -94,15 +805,111 @@ func (tm *Manager) Wait(ctx context.Context, id Id) (interface{}, error) {
 		// TODO(aroman) Depending on the desired semantics, we should probably
 		// mark the task as expirable now to avoid excessively collecting
 		// memory.
+		return ti.outputs()
+	case <-abandoned:
+		select {
+		case <-ti.done: // it finished after all
+			return ti.outputs()
+		default:
+			return nil, ErrAbandoned
+		}
+	}
+}
+
+// WaitTimeout is Wait for callers that don't have a context: it waits at most
+// d for the task and returns context.DeadlineExceeded if it isn't done by
+// then. Like with an expired context, a zero or negative d doesn't wait at all
+// but still returns the outputs of a task that's already done.
+func (tm *Manager) WaitTimeout(id Id, d time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return tm.Wait(ctx, id)
+}
+
+// lookup returns the task, or nil if there's no such task or it has expired.
+// It must be called with the mutex held.
+func (tm *Manager) lookup(id Id) *taskOutput {
+	ti := tm.tasks[id]
+	if ti == nil && tm.Store != nil {
+		ti = tm.load(id)
+	}
+	if ti != nil && tm.expired(ti, time_Now()) {
+		tm.forget(id)
+		return nil
+	}
+	return ti
+}
+
+// idTaken reports whether the id already belongs to a task, either in memory
+// or in the Store, which other Managers may be sharing. Store errors other than
+// ErrNoSuchTask are taken to mean it's free, so that a broken Store can't keep
+// Start looking for an id forever. It must be called with the mutex held.
+func (tm *Manager) idTaken(id Id) bool {
+	if tm.tasks[id] != nil {
+		return true
+	}
+	if tm.Store == nil {
+		return false
+	}
+	_, err := tm.Store.Load(id)
+	return err == nil
+}
+
+// expired must be called with the mutex held.
+func (tm *Manager) expired(ti *taskOutput, now time.Time) bool {
+	return tm.TTL > 0 && (ti.status == Done || ti.status == Failed) &&
+		now.Sub(ti.finished) >= tm.TTL
+}
+
+// sweep removes all expired tasks. Checking every task each time one starts
+// would be wasteful, so it runs at most once per TTL: lookups catch anything
+// that expires in between. It must be called with the mutex held.
+func (tm *Manager) sweep() {
+	now := time_Now()
+	if tm.TTL <= 0 || now.Before(tm.nextSweep) {
+		return
+	}
+	for id, ti := range tm.tasks {
+		if tm.expired(ti, now) {
+			tm.forget(id)
+		}
+	}
+	tm.nextSweep = now.Add(tm.TTL)
+}
+
+// outputs returns the result and error of a completed task.
+func (ti *taskOutput) outputs() (interface{}, error) {
+	if ti.err != nil {
 		return ti.result, ti.err
 	}
+	return decompress(ti.result)
+}
+
+// IsShuttingDown reports whether Shutdown has been called, after which no new
+// tasks can be started.
+func (tm *Manager) IsShuttingDown() bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.stopping
 }
 
 // Shutdown disallows new tasks from being started and waits until the existing
 // tasks all complete. This returns an error only if the provided context is
-// done before all the tasks have completed.
+// done before all the tasks have completed, in which case the remaining tasks
+// are cancelled (see ContextRunner) rather than left to run to completion.
+//
+// While it's waiting, the Manager is draining:
+//   - Start fails with ErrShuttingDown, and IsShuttingDown reports true so
+//     that callers can say so (e.g. in health checks).
+//   - Everything else keeps working. In particular, Waits (including new ones)
+//     return the results of tasks as they finish.
+//   - If the context is done first, the Waits for the unfinished tasks return
+//     ErrAbandoned instead, since they'll never finish.
 func (tm *Manager) Shutdown(ctx context.Context) error {
 	tm.mutex.Lock()
+	if !tm.stopping && tm.stopped != nil {
+		close(tm.stopped)
+	}
 	tm.stopping = true
 	tm.mutex.Unlock()
 
@@ -117,6 +924,11 @@ func (tm *Manager) Shutdown(ctx context.Context) error {
 	case <-allDone:
 		return nil
 	case <-ctx.Done():
+		tm.mutex.Lock()
+		if tm.cancelAll != nil {
+			tm.cancelAll()
+		}
+		tm.mutex.Unlock()
 		return ctx.Err()
 	}
 }
@@ -3,6 +3,14 @@ package task
 import (
 	"context"
 	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -12,6 +20,31 @@ import (
 type trackRunsTask int32
 type failTask string
 type syncTask chan string
+type typedTask string
+
+// flakyTask fails until it has been run the given number of times.
+type flakyTask struct {
+	succeedOn, runs int32
+}
+
+// blockTask blocks until the channel is closed, ignoring any context, while
+// ctxTask blocks until its context is done and reports the context's error.
+type blockTask chan struct{}
+type panicTask string
+type ctxTask chan error
+
+func (b blockTask) Run() (interface{}, error) {
+	<-b
+	return "unblocked", nil
+}
+func (c ctxTask) Run() (interface{}, error) { panic("should use RunContext") }
+func (c ctxTask) RunContext(ctx context.Context) (interface{}, error) {
+	<-ctx.Done()
+	c <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func (p panicTask) Run() (interface{}, error) { panic(string(p)) }
 
 func (t *trackRunsTask) Run() (interface{}, error) {
 	atomic.AddInt32((*int32)(t), 1)
@@ -20,6 +53,14 @@ func (t *trackRunsTask) Run() (interface{}, error) {
 func (f failTask) Run() (interface{}, error) {
 	return nil, errors.New(string(f))
 }
+func (f *flakyTask) Run() (interface{}, error) {
+	if run := atomic.AddInt32(&f.runs, 1); run < f.succeedOn {
+		return nil, fmt.Errorf("attempt %d failed", run)
+	}
+	return "finally", nil
+}
+func (t typedTask) Run() (interface{}, error) { return nil, nil }
+func (t typedTask) Type() string              { return string(t) }
 func (t syncTask) Run() (interface{}, error) {
 	t <- "started!"
 	return <-t, nil
@@ -28,9 +69,38 @@ func (t syncTask) Run() (interface{}, error) {
 // Probably should actually split these up.
 func TestManager(t *testing.T) {
 	t.Run("Start", func(t *testing.T) {
-		t.Run("returns sequential ids", func(t *testing.T) {
-			var task trackRunsTask
+		t.Run("returns unique random ids", func(t *testing.T) {
 			var tm Manager
+			var task trackRunsTask
+			seen := map[Id]bool{}
+			for i := 0; i < 100; i++ {
+				id, err := tm.Start(&task)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(id) != 22 || seen[id] {
+					t.Fatalf("Bad id: %#q", id)
+				}
+				seen[id] = true
+			}
+		})
+		t.Run("skips generated ids that are in use", func(t *testing.T) {
+			ids := []Id{"a", "a", "b"}
+			tm := Manager{IdGenerator: func() Id {
+				id := ids[0]
+				ids = ids[1:]
+				return id
+			}}
+			var task trackRunsTask
+			first, _ := tm.Start(&task)
+			second, _ := tm.Start(&task)
+			if first != "a" || second != "b" {
+				t.Errorf("Wrong ids: %#q %#q", first, second)
+			}
+		})
+		t.Run("returns sequential ids with SequentialIds", func(t *testing.T) {
+			var task trackRunsTask
+			tm := Manager{IdGenerator: SequentialIds()}
 
 			if id, err := tm.Start(&task); err != nil {
 				t.Fatal(err)
@@ -50,6 +120,47 @@ func TestManager(t *testing.T) {
 				t.Fatalf("Wrong id:%#q", id)
 			}
 		})
+		t.Run("never reuses ids of removed tasks", func(t *testing.T) {
+			ctx := context.Background()
+			var task trackRunsTask
+			tm := Manager{IdGenerator: SequentialIds()}
+			for i := 0; i < 3; i++ {
+				id, _ := tm.Start(&task)
+				tm.Wait(ctx, id)
+			}
+			// A client is still holding on to "2", even though it's gone.
+			if err := tm.Delete("2"); err != nil {
+				t.Fatal(err)
+			}
+			if id, err := tm.Start(&task); err != nil || id != "4" {
+				t.Fatalf("Wrong id: %#q %v", id, err)
+			}
+			if _, err := tm.Wait(ctx, "2"); err != ErrNoSuchTask {
+				t.Errorf("Removed task came back: %v", err)
+			}
+		})
+		t.Run("prefixes ids", func(t *testing.T) {
+			ctx := context.Background()
+			var task trackRunsTask
+			tm := Manager{IdPrefix: "hash-", IdGenerator: SequentialIds()}
+			id, _ := tm.Start(&task)
+			if id != "hash-1" {
+				t.Fatalf("Wrong id: %#q", id)
+			}
+			if res, err := tm.Wait(ctx, id); err != nil || res != "done" {
+				t.Errorf("Lookup failed: %v %v", res, err)
+			}
+			if _, err := tm.Wait(ctx, "1"); err != ErrNoSuchTask {
+				t.Errorf("Found the task without its prefix: %v", err)
+			}
+			if list := tm.List(); len(list) != 1 || list[0].Id != "hash-1" {
+				t.Errorf("Wrong list: %v", list)
+			}
+			tm.IdGenerator = nil
+			if id, _ := tm.Start(&task); !strings.HasPrefix(string(id), "hash-") || len(id) <= len("hash-") {
+				t.Errorf("Random id wasn't prefixed: %#q", id)
+			}
+		})
 		t.Run("Runs the tasks", func(t *testing.T) {
 			task := syncTask(make(chan string))
 			var tm Manager
@@ -67,7 +178,7 @@ func TestManager(t *testing.T) {
 		t.Run("returns the result of the task", func(t *testing.T) {
 			var task1 trackRunsTask
 			var task2 = failTask("oops")
-			var tm Manager
+			tm := Manager{IdGenerator: SequentialIds()}
 
 			tm.Start(&task1)
 			tm.Start(task2)
@@ -88,14 +199,14 @@ func TestManager(t *testing.T) {
 		})
 		t.Run("waits for the task to complete", func(t *testing.T) {
 			task := syncTask(make(chan string))
-			var tm Manager
+			tm := Manager{IdGenerator: SequentialIds()}
 			tm.Start(task)
 
 			done := make(chan string)
 			go func() {
 				res, err := tm.Wait(context.Background(), "1")
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
 				} else if res != "go" {
 					t.Errorf("Wrong output: %#q", res)
 				}
@@ -109,7 +220,7 @@ func TestManager(t *testing.T) {
 		})
 		t.Run("can be interrupted by the context", func(t *testing.T) {
 			task := syncTask(make(chan string))
-			var tm Manager
+			tm := Manager{IdGenerator: SequentialIds()}
 			tm.Start(task)
 
 			ctx, cancel := context.WithCancel(context.Background())
@@ -136,9 +247,1051 @@ func TestManager(t *testing.T) {
 			cancel()
 			assertRecvWithin(t, done, "", time.Second)
 		})
+		t.Run("WaitTimeout gives up after the duration", func(t *testing.T) {
+			block := make(blockTask)
+			tm := Manager{IdGenerator: SequentialIds()}
+			tm.Start(block)
+
+			start := time.Now()
+			if res, err := tm.WaitTimeout("1", 10*time.Millisecond); err != context.DeadlineExceeded {
+				t.Fatalf("Expected a timeout: res=%#v err=%v", res, err)
+			}
+			if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+				t.Errorf("Didn't wait long enough: %v", elapsed)
+			}
+
+			close(block)
+			if res, err := tm.WaitTimeout("1", time.Second); err != nil || res != "unblocked" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+			// Once it's done, even a zero timeout gets the result.
+			if res, err := tm.WaitTimeout("1", 0); err != nil || res != "unblocked" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+		})
+		t.Run("still returns the result after a timed out wait", func(t *testing.T) {
+			task := syncTask(make(chan string))
+			tm := Manager{IdGenerator: SequentialIds()}
+			tm.Start(task)
+			assertRecvWithin(t, task, "started!", time.Second)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if res, err := tm.Wait(ctx, "1"); err != context.DeadlineExceeded {
+				t.Fatalf("Expected a timeout: res=%#v err=%v", res, err)
+			}
+
+			task <- "finally"
+			if res, err := tm.Wait(context.Background(), "1"); err != nil {
+				t.Fatal(err)
+			} else if res != "finally" {
+				t.Errorf("Wrong output: %#v", res)
+			}
+		})
 		// TODO: test ErrNoSuchTask
 	})
-	// TODO: Test shutdown
+	t.Run("doesn't leak goroutines", func(t *testing.T) {
+		before := runtime.NumGoroutine()
+
+		tm := Manager{IdGenerator: SequentialIds()}
+		var task trackRunsTask
+		const N = 100
+		for i := 0; i < N; i++ {
+			tm.Start(&task)
+		}
+		for i := 1; i <= N; i++ {
+			if _, err := tm.Wait(context.Background(), Id(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The task goroutines may still be on their way out after signaling
+		// completion, so give them a moment to settle.
+		var after int
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			if after = runtime.NumGoroutine(); after <= before {
+				return
+			}
+		}
+		t.Errorf("Leaked %d goroutines after running %d tasks", after-before, N)
+	})
+	t.Run("OnStateChange", func(t *testing.T) {
+		t.Run("reports each transition", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			changes := recordStateChanges(&tm)
+
+			tm.Start(failTask("oops"))
+			assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+			assertRecvWithin(t, changes, "1: running -> failed", time.Second)
+
+			task := syncTask(make(chan string))
+			tm.Start(task)
+			assertRecvWithin(t, changes, "2: pending -> running", time.Second)
+			assertRecvWithin(t, task, "started!", time.Second)
+			assertNoRecvWithin(t, changes, 50*time.Millisecond)
+			task <- "finish"
+			assertRecvWithin(t, changes, "2: running -> done", time.Second)
+		})
+		t.Run("fires after the result is available", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			changes := recordStateChanges(&tm)
+			var task trackRunsTask
+			tm.Start(&task)
+			assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+			assertRecvWithin(t, changes, "1: running -> done", time.Second)
+
+			if res, err := tm.Wait(context.Background(), "1"); err != nil || res != "done" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+		})
+	})
+	t.Run("OnComplete", func(t *testing.T) {
+		t.Run("reports the outputs", func(t *testing.T) {
+			type outputs struct {
+				id     Id
+				result interface{}
+				err    error
+			}
+			completed := make(chan outputs, 2)
+			tm := Manager{IdGenerator: SequentialIds(), CompressAbove: 1}
+			tm.OnComplete = func(id Id, result interface{}, err error) {
+				completed <- outputs{id, result, err}
+			}
+			tm.Start(new(trackRunsTask))
+			if out := <-completed; out.id != "1" || out.result != "done" || out.err != nil {
+				t.Errorf("Wrong outputs: %+v", out)
+			}
+			tm.Start(failTask("oops"))
+			if out := <-completed; out.id != "2" || out.err == nil || out.err.Error() != "oops" {
+				t.Errorf("Wrong outputs: %+v", out)
+			}
+		})
+		t.Run("survives a panic", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			tm.OnComplete = func(id Id, result interface{}, err error) { panic("boom") }
+			tm.Start(new(trackRunsTask))
+			if res, err := tm.Wait(context.Background(), "1"); err != nil || res != "done" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+			if err := tm.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+	t.Run("Vars", func(t *testing.T) {
+		tm := Manager{Vars: new(expvar.Map)}
+		block := make(blockTask)
+		tm.Start(new(trackRunsTask))
+		tm.Start(failTask("oops"))
+		id, _ := tm.Start(block)
+		for info, _ := tm.Info(id); info.Status != Running; info, _ = tm.Info(id) {
+			time.Sleep(time.Millisecond)
+		}
+		// The other two finished first, since they didn't block.
+		for tm.InFlight() > 1 {
+			time.Sleep(time.Millisecond)
+		}
+		expected := map[string]string{"started": "3", "running": "1", "completed": "1", "failed": "1"}
+		for name, val := range expected {
+			if v := tm.Vars.Get(name); v == nil || v.String() != val {
+				t.Errorf("Wrong %s: %v, expected %s", name, v, val)
+			}
+		}
+		close(block)
+		tm.Shutdown(context.Background())
+		if v := tm.Vars.Get("running").String(); v != "0" {
+			t.Errorf("Still running after shutdown: %s", v)
+		}
+	})
+	t.Run("Metrics", func(t *testing.T) {
+		ctx := context.Background()
+		tm := Manager{MaxConcurrent: 1}
+		done, _ := tm.Start(new(trackRunsTask))
+		tm.Wait(ctx, done)
+		failed, _ := tm.Start(failTask("oops"))
+		tm.Wait(ctx, failed)
+		running, queued := make(blockTask), make(blockTask)
+		id, _ := tm.Start(running)
+		for info, _ := tm.Info(id); info.Status != Running; info, _ = tm.Info(id) {
+			time.Sleep(time.Millisecond)
+		}
+		tm.Start(queued) // has to wait for the running one
+
+		// The timings are covered below.
+		counts := func(m ManagerMetrics) ManagerMetrics {
+			m.AvgQueueWait, m.AvgRunTime = 0, 0
+			return m
+		}
+		expected := ManagerMetrics{Queued: 1, Running: 1, Completed: 1, Failed: 1}
+		if m := counts(tm.Metrics()); m != expected {
+			t.Errorf("Wrong metrics:\nHave: %+v\nWant: %+v", m, expected)
+		}
+		close(running)
+		close(queued)
+		tm.Shutdown(ctx)
+		expected = ManagerMetrics{Completed: 3, Failed: 1}
+		if m := counts(tm.Metrics()); m != expected {
+			t.Errorf("Wrong metrics after shutdown:\nHave: %+v\nWant: %+v", m, expected)
+		}
+
+		t.Run("separates queue wait from run time", func(t *testing.T) {
+			defer func() { time_Now = time.Now }()
+			now := time.Now()
+			time_Now = func() time.Time { return now }
+
+			tm := Manager{MaxConcurrent: 1}
+			defer tm.Shutdown(ctx) // before restoring time_Now
+			if m := tm.Metrics(); m.AvgQueueWait != 0 || m.AvgRunTime != 0 {
+				t.Errorf("Averages without any tasks: %+v", m)
+			}
+			// Only one of them runs at a time, so both can share the channel.
+			task := syncTask(make(chan string))
+			first, _ := tm.Start(task)
+			second, _ := tm.Start(task) // one of them has to wait
+			assertRecvWithin(t, task, "started!", time.Second)
+
+			now = now.Add(10 * time.Second)
+			task <- "done" // ran for 10s, then the other one gets its turn
+			assertRecvWithin(t, task, "started!", time.Second)
+			if m := tm.Metrics(); m.AvgQueueWait != 5*time.Second || m.AvgRunTime != 10*time.Second {
+				t.Errorf("Wrong timings: %+v", m)
+			}
+
+			now = now.Add(30 * time.Second)
+			task <- "done"
+			tm.Wait(ctx, first)
+			tm.Wait(ctx, second)
+			if m := tm.Metrics(); m.AvgQueueWait != 5*time.Second || m.AvgRunTime != 20*time.Second {
+				t.Errorf("Wrong timings after both finished: %+v", m)
+			}
+
+			// The queue waits are kept for percentiles too.
+			q := tm.QueueStats()
+			if q.Count != 2 || q.Total != 10*time.Second || q.Max != 10*time.Second {
+				t.Errorf("Wrong queue stats: %d %v %v", q.Count, q.Total, q.Max)
+			}
+			if p := q.Latency.Percentile(100); p < 10*time.Second || p > 11*time.Second {
+				t.Errorf("Wrong queue wait p100: %v", p)
+			}
+		})
+	})
+	t.Run("Info", func(t *testing.T) {
+		t.Run("tracks the task's progress", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			task := syncTask(make(chan string))
+			before := time.Now()
+			tm.Start(task)
+			assertRecvWithin(t, task, "started!", time.Second)
+
+			info, err := tm.Info("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Id != "1" || info.Type != "task.syncTask" || info.Status != Running {
+				t.Errorf("Wrong info: %+v", info)
+			}
+			if info.Created.Before(before) || info.Started.Before(info.Created) {
+				t.Errorf("Wrong timestamps: %+v", info)
+			}
+			if !info.Finished.IsZero() {
+				t.Errorf("Finished before finishing: %+v", info)
+			}
+
+			task <- "done"
+			tm.Wait(context.Background(), "1")
+			if info, _ = tm.Info("1"); info.Status != Done || info.Finished.Before(info.Started) {
+				t.Errorf("Wrong info after finishing: %+v", info)
+			}
+		})
+		t.Run("fails for unknown tasks", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			if _, err := tm.Info("1"); err != ErrNoSuchTask {
+				t.Errorf("Wrong error: %v", err)
+			}
+		})
+	})
+	t.Run("Status", func(t *testing.T) {
+		tm := Manager{MaxConcurrent: 1, IdGenerator: SequentialIds()}
+		changes := recordStateChanges(&tm)
+		first, second := make(syncTask), make(syncTask)
+		tm.Start(first)
+		<-first // started
+		tm.Start(second)
+
+		assertStatus := func(id Id, expected TaskStatus) {
+			t.Helper()
+			if status, err := tm.Status(id); err != nil || status != expected {
+				t.Errorf("Wrong status for %s: %v (err=%v), expected %v", id, status, err, expected)
+			}
+		}
+		assertStatus("1", Running)
+		assertStatus("2", Pending) // waiting for a turn
+
+		first <- "done"
+		assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+		assertRecvWithin(t, changes, "1: running -> done", time.Second)
+		<-second // started
+		assertStatus("1", Done)
+		assertStatus("2", Running)
+
+		second <- "done"
+		assertRecvWithin(t, changes, "2: pending -> running", time.Second)
+		assertRecvWithin(t, changes, "2: running -> done", time.Second)
+		assertStatus("2", Done)
+
+		if _, err := tm.Status("3"); err != ErrNoSuchTask {
+			t.Errorf("Expected ErrNoSuchTask, got %v", err)
+		}
+	})
+	t.Run("List", func(t *testing.T) {
+		tm := Manager{IdGenerator: SequentialIds()}
+		changes := recordStateChanges(&tm)
+		tm.Start(new(trackRunsTask))
+		assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+		assertRecvWithin(t, changes, "1: running -> done", time.Second)
+		tm.Start(failTask("oops"))
+		assertRecvWithin(t, changes, "2: pending -> running", time.Second)
+		assertRecvWithin(t, changes, "2: running -> failed", time.Second)
+		task := make(syncTask)
+		tm.Start(task)
+		<-task // started
+
+		var statuses []string
+		for _, info := range tm.List() {
+			statuses = append(statuses, fmt.Sprintf("%s: %s", info.Id, info.Status))
+		}
+		if got := fmt.Sprint(statuses); got != "[1: done 2: failed 3: running]" {
+			t.Errorf("Wrong list: %s", got)
+		}
+		task <- "finished"
+
+		if list := (&Manager{}).List(); len(list) != 0 {
+			t.Errorf("Expected an empty list: %v", list)
+		}
+	})
+	t.Run("InFlight", func(t *testing.T) {
+		t.Run("counts tasks until they complete", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			changes := recordStateChanges(&tm)
+			if n := tm.InFlight(); n != 0 {
+				t.Errorf("Wrong count before starting: %d", n)
+			}
+
+			task := syncTask(make(chan string))
+			tm.Start(task)
+			assertRecvWithin(t, task, "started!", time.Second)
+			assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+			tm.Start(failTask("oops"))
+			assertRecvWithin(t, changes, "2: pending -> running", time.Second)
+			assertRecvWithin(t, changes, "2: running -> failed", time.Second)
+			if n := tm.InFlight(); n != 1 {
+				t.Errorf("Wrong count with one task running: %d", n)
+			}
+
+			task <- "finish"
+			assertRecvWithin(t, changes, "1: running -> done", time.Second)
+			if n := tm.InFlight(); n != 0 {
+				t.Errorf("Wrong count after finishing: %d", n)
+			}
+		})
+	})
+	t.Run("RunStats", func(t *testing.T) {
+		t.Run("are segmented by task type", func(t *testing.T) {
+			var tm Manager
+			var task trackRunsTask
+			tm.Start(&task)
+			tm.Start(&task)
+			tm.Start(failTask("oops"))
+			tm.Start(typedTask("custom"))
+			tm.Shutdown(context.Background()) // wait for them all to finish
+
+			stats := tm.RunStats()
+			if len(stats) != 3 {
+				t.Errorf("Wrong number of types: %v", stats)
+			}
+			if n := stats["*task.trackRunsTask"].Count; n != 2 {
+				t.Errorf("Wrong count for trackRunsTask: %d", n)
+			}
+			if n := stats["task.failTask"].Count; n != 1 {
+				t.Errorf("Wrong count for failTask: %d", n)
+			}
+			if n := stats["custom"].Count; n != 1 {
+				t.Errorf("Wrong count for typedTask: %d", n)
+			}
+		})
+		t.Run("handles no data", func(t *testing.T) {
+			var tm Manager
+			if stats := tm.RunStats(); len(stats) != 0 {
+				t.Errorf("Expected no stats: %v", stats)
+			}
+			if avg := (RunStats{}).Average(); avg != 0 {
+				t.Errorf("Wrong average for no data: %v", avg)
+			}
+		})
+	})
+	t.Run("TTL", func(t *testing.T) {
+		t.Run("expires completed tasks", func(t *testing.T) {
+			defer func() { time_Now = time.Now }()
+			now := time.Now()
+			time_Now = func() time.Time { return now }
+
+			tm := Manager{TTL: time.Minute, IdGenerator: SequentialIds()}
+			defer tm.Shutdown(context.Background()) // before restoring time_Now
+			changes := recordStateChanges(&tm)
+			var task trackRunsTask
+			tm.Start(&task)
+			assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+			assertRecvWithin(t, changes, "1: running -> done", time.Second)
+
+			now = now.Add(59 * time.Second)
+			if res, err := tm.Wait(context.Background(), "1"); err != nil || res != "done" {
+				t.Errorf("Expired too early: res=%#v err=%v", res, err)
+			}
+
+			now = now.Add(time.Second)
+			if _, err := tm.Info("1"); err != ErrNoSuchTask {
+				t.Errorf("Expected task to have expired: %v", err)
+			}
+			if _, err := tm.Wait(context.Background(), "1"); err != ErrNoSuchTask {
+				t.Errorf("Expected task to have expired: %v", err)
+			}
+			if len(tm.tasks) != 0 {
+				t.Errorf("Expired task is still there: %v", tm.tasks)
+			}
+		})
+		t.Run("sweeps expired tasks that are never looked up", func(t *testing.T) {
+			defer func() { time_Now = time.Now }()
+			now := time.Now()
+			time_Now = func() time.Time { return now }
+
+			tm := Manager{TTL: time.Minute, IdGenerator: SequentialIds()}
+			defer tm.Shutdown(context.Background()) // before restoring time_Now
+			var task trackRunsTask
+			for i := 0; i < 2; i++ {
+				id, _ := tm.Start(&task)
+				tm.Wait(context.Background(), id)
+			}
+
+			now = now.Add(time.Hour)
+			tm.Start(&task)
+			tm.mutex.Lock()
+			defer tm.mutex.Unlock()
+			if len(tm.tasks) != 1 || tm.tasks["3"] == nil {
+				t.Errorf("Expired tasks weren't swept: %v", tm.tasks)
+			}
+		})
+		t.Run("never expires tasks that are still running", func(t *testing.T) {
+			defer func() { time_Now = time.Now }()
+			now := time.Now()
+			time_Now = func() time.Time { return now }
+
+			tm := Manager{TTL: time.Minute, IdGenerator: SequentialIds()}
+			defer tm.Shutdown(context.Background()) // before restoring time_Now
+			task := make(syncTask)
+			tm.Start(task)
+			<-task // started
+
+			now = now.Add(time.Hour)
+			if _, err := tm.Info("1"); err != nil {
+				t.Errorf("Running task expired: %v", err)
+			}
+			task <- "finished"
+			if res, err := tm.Wait(context.Background(), "1"); err != nil || res != "finished" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+		})
+		t.Run("doesn't interfere with waits in progress", func(t *testing.T) {
+			// This is mostly for -race: Wait, expiry and lookups all racing.
+			tm := Manager{TTL: time.Millisecond}
+			// The stray tasks below are never waited on, and later tests fake
+			// time_Now, so they mustn't still be running by then.
+			defer tm.Shutdown(context.Background()) // before restoring time_Now
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				task := make(syncTask)
+				id, _ := tm.Start(task)
+				<-task // started
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					// Either the Wait started before expiry and gets the
+					// result, or it didn't and the task is gone.
+					res, err := tm.Wait(context.Background(), id)
+					if err != nil && err != ErrNoSuchTask || err == nil && res != "ok" {
+						t.Errorf("Wrong output for %s: res=%#v err=%v", id, res, err)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					tm.Info(id)
+					tm.Start(new(trackRunsTask))
+				}()
+				task <- "ok"
+			}
+			wg.Wait()
+		})
+	})
+	t.Run("StartOnce", func(t *testing.T) {
+		t.Run("starts one task per key", func(t *testing.T) {
+			var task trackRunsTask
+			tm := Manager{IdGenerator: SequentialIds()}
+			first, _ := tm.StartOnce("key", &task)
+			tm.Wait(context.Background(), first)
+			if again, err := tm.StartOnce("key", &task); err != nil || again != first {
+				t.Errorf("Started another task for the same key: %#q %v", again, err)
+			}
+			other, _ := tm.StartOnce("other", &task)
+			if other == first {
+				t.Errorf("Reused the task for a different key")
+			}
+			tm.Wait(context.Background(), other)
+			if int(task) != 2 {
+				t.Errorf("Wrong number of runs: %d", task)
+			}
+		})
+		t.Run("starts a new task once the old one is gone", func(t *testing.T) {
+			defer func() { time_Now = time.Now }()
+			now := time.Now()
+			time_Now = func() time.Time { return now }
+
+			var task trackRunsTask
+			tm := Manager{IdGenerator: SequentialIds(), TTL: time.Minute}
+			defer tm.Shutdown(context.Background()) // before restoring time_Now
+			first, _ := tm.StartOnce("key", &task)
+			tm.Wait(context.Background(), first)
+			tm.Delete(first)
+			second, _ := tm.StartOnce("key", &task)
+			if second == first {
+				t.Fatalf("Reused the deleted task %#q", first)
+			}
+			tm.Wait(context.Background(), second)
+
+			now = now.Add(2 * time.Minute) // the second one expires
+			if third, _ := tm.StartOnce("key", &task); third == second {
+				t.Errorf("Reused the expired task %#q", second)
+			}
+		})
+		t.Run("returns the existing task even when shutting down", func(t *testing.T) {
+			var task trackRunsTask
+			var tm Manager
+			first, _ := tm.StartOnce("key", &task)
+			tm.Shutdown(context.Background())
+			if again, err := tm.StartOnce("key", &task); err != nil || again != first {
+				t.Errorf("Wrong output: %#q %v", again, err)
+			}
+			if _, err := tm.StartOnce("other", &task); err != ErrShuttingDown {
+				t.Errorf("Started a new task while shutting down: %v", err)
+			}
+		})
+	})
+	t.Run("StartWithTimeout", func(t *testing.T) {
+		t.Run("stops context-aware tasks", func(t *testing.T) {
+			var tm Manager
+			task := make(ctxTask, 1)
+			id, _ := tm.StartWithTimeout(task, 10*time.Millisecond)
+			if _, err := tm.Wait(context.Background(), id); err != context.DeadlineExceeded {
+				t.Errorf("Wrong error: %v", err)
+			}
+			select {
+			case err := <-task:
+				if err != context.DeadlineExceeded {
+					t.Errorf("Task saw the wrong error: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("Task never saw its context expire")
+			}
+			if info, _ := tm.Info(id); info.Status != Failed {
+				t.Errorf("Wrong status: %v", info.Status)
+			}
+		})
+		t.Run("abandons other tasks", func(t *testing.T) {
+			var tm Manager
+			block := make(blockTask)
+			defer close(block)
+			id, _ := tm.StartWithTimeout(block, 10*time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if _, err := tm.Wait(ctx, id); err != context.DeadlineExceeded {
+				t.Errorf("Wrong error: %v", err)
+			}
+			if ctx.Err() != nil {
+				t.Errorf("Timeout wasn't honored")
+			}
+		})
+		t.Run("doesn't affect tasks that finish in time", func(t *testing.T) {
+			var tm Manager
+			id, _ := tm.StartWithTimeout(new(trackRunsTask), time.Minute)
+			if res, err := tm.Wait(context.Background(), id); err != nil || res != "done" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+		})
+	})
+	t.Run("StartWithRetry", func(t *testing.T) {
+		t.Run("retries until the task succeeds", func(t *testing.T) {
+			var tm Manager
+			task := &flakyTask{succeedOn: 3}
+			id, _ := tm.StartWithRetry(task, RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond})
+			if res, err := tm.Wait(context.Background(), id); err != nil || res != "finally" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+			if runs := atomic.LoadInt32(&task.runs); runs != 3 {
+				t.Errorf("Expected 3 runs, got %d", runs)
+			}
+		})
+		t.Run("reports the last failure", func(t *testing.T) {
+			var tm Manager
+			task := &flakyTask{succeedOn: 10}
+			id, _ := tm.StartWithRetry(task, RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+			if _, err := tm.Wait(context.Background(), id); err == nil || err.Error() != "attempt 2 failed" {
+				t.Errorf("Wrong error: %v", err)
+			}
+			if runs := atomic.LoadInt32(&task.runs); runs != 2 {
+				t.Errorf("Expected 2 runs, got %d", runs)
+			}
+		})
+		t.Run("stops retrying on shutdown", func(t *testing.T) {
+			var tm Manager
+			task := &flakyTask{succeedOn: 10}
+			id, _ := tm.StartWithRetry(task, RetryPolicy{MaxAttempts: 5, Backoff: time.Hour})
+			for atomic.LoadInt32(&task.runs) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := tm.Shutdown(ctx); err != nil {
+				t.Fatalf("Shutdown waited out the backoff: %v", err)
+			}
+			if _, err := tm.Wait(context.Background(), id); err == nil || err.Error() != "attempt 1 failed" {
+				t.Errorf("Wrong error: %v", err)
+			}
+		})
+	})
+	t.Run("Shutdown", func(t *testing.T) {
+		t.Run("waits for tasks to finish", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			task := make(syncTask)
+			tm.Start(task)
+			<-task // started
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				task <- "finished"
+			}()
+			if err := tm.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if res, err := tm.Wait(context.Background(), "1"); err != nil || res != "finished" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+		})
+		t.Run("releases waiters once it gives up waiting", func(t *testing.T) {
+			for _, task := range []Interface{make(ctxTask, 1), make(blockTask)} {
+				var tm Manager
+				id, _ := tm.Start(task)
+				waited := make(chan error)
+				go func() {
+					_, err := tm.Wait(context.Background(), id)
+					waited <- err
+				}()
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				tm.Shutdown(ctx)
+				cancel()
+				select {
+				case err := <-waited:
+					if err != ErrAbandoned {
+						t.Errorf("%T: wrong error: %v", task, err)
+					}
+				case <-time.After(time.Second):
+					t.Errorf("%T: waiter was never released", task)
+				}
+				if block, ok := task.(blockTask); ok {
+					close(block)
+				}
+				// Later waits see the same thing.
+				if _, err := tm.Wait(context.Background(), id); err != ErrAbandoned {
+					t.Errorf("%T: wrong error: %v", task, err)
+				}
+			}
+		})
+		t.Run("drains", func(t *testing.T) {
+			ctx := context.Background()
+			tm := Manager{IdGenerator: SequentialIds()}
+			task := make(syncTask)
+			tm.Start(task)
+			<-task // started
+			waited := make(chan string)
+			go func() {
+				res, err := tm.Wait(ctx, "1")
+				waited <- fmt.Sprintf("%v %v", res, err)
+			}()
+			shutdown := make(chan error)
+			go func() { shutdown <- tm.Shutdown(ctx) }()
+			for !tm.IsShuttingDown() {
+				time.Sleep(time.Millisecond)
+			}
+
+			// No new tasks...
+			if _, err := tm.Start(new(trackRunsTask)); err != ErrShuttingDown {
+				t.Errorf("Started a task while draining: %v", err)
+			}
+			// ...but the running one finishes, for old and new waiters alike.
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				task <- "finished"
+			}()
+			if res, err := tm.Wait(ctx, "1"); err != nil || res != "finished" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+			assertRecvWithin(t, waited, "finished <nil>", time.Second)
+			if err := <-shutdown; err != nil {
+				t.Errorf("Shutdown failed: %v", err)
+			}
+		})
+		t.Run("reports that it's shutting down", func(t *testing.T) {
+			var tm Manager
+			if tm.IsShuttingDown() {
+				t.Errorf("Shutting down before Shutdown")
+			}
+			tm.Shutdown(context.Background())
+			if !tm.IsShuttingDown() {
+				t.Errorf("Not shutting down after Shutdown")
+			}
+		})
+		t.Run("cancels tasks once it gives up waiting", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			task := make(ctxTask, 1)
+			tm.Start(task)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if err := tm.Shutdown(ctx); err != context.DeadlineExceeded {
+				t.Errorf("Wrong error: %v", err)
+			}
+			select {
+			case err := <-task:
+				if err != context.Canceled {
+					t.Errorf("Task saw the wrong error: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Task was never cancelled")
+			}
+			if _, err := tm.Wait(context.Background(), "1"); err != ErrAbandoned {
+				t.Errorf("Wrong error: %v", err)
+			}
+		})
+	})
+	t.Run("Delete", func(t *testing.T) {
+		t.Run("forgets completed tasks", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			id, _ := tm.Start(new(trackRunsTask))
+			tm.Wait(context.Background(), id)
+			if err := tm.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tm.Wait(context.Background(), id); err != ErrNoSuchTask {
+				t.Errorf("Task wasn't deleted: %v", err)
+			}
+			if err := tm.Delete(id); err != ErrNoSuchTask {
+				t.Errorf("Deleted twice: %v", err)
+			}
+		})
+		t.Run("cancels running tasks", func(t *testing.T) {
+			var tm Manager
+			changes := recordStateChanges(&tm)
+			task := make(ctxTask, 1)
+			id, _ := tm.Start(task)
+			assertRecvWithin(t, changes, string(id)+": pending -> running", time.Second)
+			if err := tm.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-task:
+				if err != context.Canceled {
+					t.Errorf("Task saw the wrong error: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Task was never cancelled")
+			}
+			if _, err := tm.Info(id); err != ErrNoSuchTask {
+				t.Errorf("Task wasn't deleted: %v", err)
+			}
+		})
+		t.Run("never runs pending tasks", func(t *testing.T) {
+			tm := Manager{MaxConcurrent: 1}
+			block := make(blockTask)
+			tm.Start(block)
+			var task trackRunsTask
+			id, _ := tm.Start(&task)
+			if info, _ := tm.Info(id); info.Status != Pending {
+				t.Fatalf("Task should be pending: %v", info.Status)
+			}
+			if err := tm.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			close(block)
+			tm.Shutdown(context.Background())
+			if n := atomic.LoadInt32((*int32)(&task)); n != 0 {
+				t.Errorf("Deleted task ran anyway")
+			}
+		})
+	})
+	t.Run("CancelAll", func(t *testing.T) {
+		ctx := context.Background()
+		tm := Manager{MaxConcurrent: 2, IdGenerator: SequentialIds()}
+		changes := recordStateChanges(&tm)
+		cancellable := make(ctxTask, 1)
+		tm.Start(cancellable)
+		assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+		stuck := make(blockTask) // ignores its context
+		tm.Start(stuck)
+		assertRecvWithin(t, changes, "2: pending -> running", time.Second)
+		var queued trackRunsTask
+		tm.Start(&queued)
+
+		if cancelled, skipped := tm.CancelAll(); cancelled != 2 || skipped != 1 {
+			t.Errorf("Wrong counts: cancelled=%d skipped=%d", cancelled, skipped)
+		}
+		for _, id := range []Id{"1", "3"} {
+			if _, err := tm.Wait(ctx, id); err != context.Canceled {
+				t.Errorf("Wrong error for %s: %v", id, err)
+			}
+		}
+		close(stuck)
+		if res, err := tm.Wait(ctx, "2"); err != nil || res != "unblocked" {
+			t.Errorf("Skipped task didn't finish: %v %v", res, err)
+		}
+		if queued != 0 {
+			t.Errorf("Cancelled task ran anyway")
+		}
+		tm.Shutdown(ctx)
+		if cancelled, skipped := tm.CancelAll(); cancelled != 0 || skipped != 0 {
+			t.Errorf("Cancelled finished tasks: cancelled=%d skipped=%d", cancelled, skipped)
+		}
+	})
+	t.Run("MaxConcurrent", func(t *testing.T) {
+		t.Run("limits how many tasks run at once", func(t *testing.T) {
+			tm := Manager{MaxConcurrent: 2}
+			started := make(chan string, 10)
+			tasks := make([]syncTask, 4)
+			for i := range tasks {
+				tasks[i] = make(syncTask)
+				tm.Start(tasks[i])
+				go func(i int) {
+					<-tasks[i]
+					started <- strconv.Itoa(i)
+				}(i)
+			}
+
+			running := []string{}
+			for len(running) < 2 {
+				select {
+				case i := <-started:
+					running = append(running, i)
+				case <-time.After(time.Second):
+					t.Fatalf("Only %d tasks started", len(running))
+				}
+			}
+			assertNoRecvWithin(t, started, 50*time.Millisecond)
+
+			// Finishing one lets the next one run, and so on.
+			for queued := len(tasks) - 2; len(running) > 0; {
+				i, _ := strconv.Atoi(running[0])
+				tasks[i] <- "done"
+				running = running[1:]
+				if queued > 0 {
+					select {
+					case i := <-started:
+						running = append(running, i)
+						queued--
+					case <-time.After(time.Second):
+						t.Fatalf("Next task didn't start")
+					}
+				}
+				assertNoRecvWithin(t, started, 10*time.Millisecond)
+			}
+			if err := tm.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+		t.Run("counts timed out tasks until they really return", func(t *testing.T) {
+			ctx := context.Background()
+			tm := Manager{MaxConcurrent: 1, IdGenerator: SequentialIds()}
+			stuck := make(blockTask) // ignores its context
+			tm.StartWithTimeout(stuck, 10*time.Millisecond)
+			for info, _ := tm.Info("1"); info.Status != Running; info, _ = tm.Info("1") {
+				time.Sleep(time.Millisecond)
+			}
+			next := make(syncTask)
+			tm.Start(next)
+			if _, err := tm.Wait(ctx, "1"); err != context.DeadlineExceeded {
+				t.Errorf("Wrong error: %v", err)
+			}
+			// The first one's Run is still going, so it's still its turn.
+			select {
+			case <-next:
+				t.Fatalf("Ran more than MaxConcurrent tasks at once")
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(stuck)
+			select {
+			case <-next:
+			case <-time.After(time.Second):
+				t.Fatalf("Next task never started")
+			}
+			next <- "done"
+			tm.Shutdown(ctx)
+		})
+		t.Run("abandons queued tasks without waiting for a turn", func(t *testing.T) {
+			tm := Manager{MaxConcurrent: 1, IdGenerator: SequentialIds()}
+			stuck := make(blockTask) // ignores its context
+			defer close(stuck)
+			tm.Start(stuck)
+			for info, _ := tm.Info("1"); info.Status != Running; info, _ = tm.Info("1") {
+				time.Sleep(time.Millisecond)
+			}
+			var queued trackRunsTask
+			tm.Start(&queued)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			tm.Shutdown(ctx)
+			// Wait reports ErrAbandoned as soon as Shutdown gives up, so check
+			// that the task itself really failed rather than staying queued.
+			deadline := time.Now().Add(time.Second)
+			info, _ := tm.Info("2")
+			for ; info.Status != Failed && time.Now().Before(deadline); info, _ = tm.Info("2") {
+				time.Sleep(time.Millisecond)
+			}
+			if info.Status != Failed {
+				t.Fatalf("Queued task is still %v", info.Status)
+			}
+			if _, err := tm.Wait(context.Background(), "2"); err != ErrAbandoned {
+				t.Errorf("Wrong error: %v", err)
+			}
+			if queued != 0 {
+				t.Errorf("Abandoned task ran anyway")
+			}
+			if m := tm.Metrics(); m.Queued != 0 || m.Failed != 2 { // both abandoned
+				t.Errorf("Wrong metrics: %+v", m)
+			}
+		})
+		t.Run("rejects tasks beyond MaxQueued", func(t *testing.T) {
+			tm := Manager{MaxConcurrent: 1, MaxQueued: 1}
+			block := make(syncTask)
+			if _, err := tm.Start(block); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tm.Start(new(trackRunsTask)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tm.Start(new(trackRunsTask)); err != ErrQueueFull {
+				t.Errorf("Expected ErrQueueFull, got %v", err)
+			}
+
+			<-block
+			block <- "done"
+			tm.Shutdown(context.Background())
+			if _, err := tm.Start(new(trackRunsTask)); err != ErrShuttingDown {
+				t.Errorf("Expected ErrShuttingDown, got %v", err)
+			}
+		})
+	})
+	t.Run("recovers from panics", func(t *testing.T) {
+		var logs strings.Builder
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+		ctx := context.Background()
+
+		t.Run("in tasks", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			tm.Start(panicTask("boom"))
+			// Tasks with a timeout run in their own goroutine.
+			tm.StartWithTimeout(panicTask("bang"), time.Minute)
+			for id, expected := range map[Id]string{"1": "boom", "2": "bang"} {
+				if res, err := tm.Wait(ctx, id); err == nil || err.Error() != "task panicked: "+expected {
+					t.Errorf("Wrong output for %s: res=%#v err=%v", id, res, err)
+				}
+			}
+			if status, _ := tm.Status("1"); status != Failed {
+				t.Errorf("Wrong status: %v", status)
+			}
+			if err := tm.Shutdown(ctx); err != nil {
+				t.Errorf("Shutdown didn't see the tasks finish: %v", err)
+			}
+			if !strings.Contains(logs.String(), "Task panicked: boom") {
+				t.Errorf("Didn't log the panic:\n%s", logs.String())
+			}
+		})
+		t.Run("in middlewares", func(t *testing.T) {
+			tm := Manager{IdGenerator: SequentialIds()}
+			tm.Use(func(next TaskFunc) TaskFunc {
+				return func() (interface{}, error) { panic("oops") }
+			})
+			tm.Start(new(trackRunsTask))
+			if res, err := tm.Wait(ctx, "1"); err == nil || err.Error() != "task panicked: oops" {
+				t.Errorf("Wrong output: res=%#v err=%v", res, err)
+			}
+		})
+	})
+	t.Run("Use", func(t *testing.T) {
+		t.Run("composes middleware around each task", func(t *testing.T) {
+			var tm Manager
+			var calls []string
+			trace := func(name string) Middleware {
+				return func(next TaskFunc) TaskFunc {
+					return func() (interface{}, error) {
+						calls = append(calls, name+" before")
+						res, err := next()
+						calls = append(calls, name+" after")
+						return fmt.Sprintf("%s(%v)", name, res), err
+					}
+				}
+			}
+			tm.Use(trace("outer"))
+			tm.Use(trace("inner"))
+
+			var task trackRunsTask
+			id, _ := tm.Start(&task)
+			res, err := tm.Wait(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != "outer(inner(done))" {
+				t.Errorf("Wrong result: %v", res)
+			}
+			if task != 1 {
+				t.Errorf("Task should have run once, but ran %d times", task)
+			}
+			expected := "[outer before inner before inner after outer after]"
+			if fmt.Sprint(calls) != expected {
+				t.Errorf("Wrong call order:\n  got  %v\n  want %v", calls, expected)
+			}
+		})
+		t.Run("can replace the error", func(t *testing.T) {
+			var tm Manager
+			tm.Use(func(next TaskFunc) TaskFunc {
+				return func() (interface{}, error) {
+					if _, err := next(); err != nil {
+						return nil, fmt.Errorf("wrapped: %w", err)
+					}
+					return nil, nil
+				}
+			})
+			id, _ := tm.Start(failTask("oops"))
+			_, err := tm.Wait(context.Background(), id)
+			if err == nil || err.Error() != "wrapped: oops" {
+				t.Errorf("Wrong error: %v", err)
+			}
+		})
+	})
+}
+
+// recordStateChanges hooks the manager so that every state change is sent as
+// a string on the returned channel.
+func recordStateChanges(tm *Manager) chan string {
+	changes := make(chan string, 100)
+	tm.OnStateChange = func(id Id, from, to TaskStatus) {
+		changes <- fmt.Sprintf("%s: %s -> %s", id, from, to)
+	}
+	return changes
 }
 
 func assertRecvWithin(t *testing.T, ch chan string, expected string, timeout time.Duration) {
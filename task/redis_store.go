@@ -0,0 +1,156 @@
+package task
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisStore is a Store that keeps each task as a JSON string in Redis, so
+// that several hashex instances behind a load balancer can share results: a
+// task started on one instance can be fetched from any other once it's done.
+// Like DirStore, results come back as their generic JSON equivalents.
+//
+// It speaks just enough of the Redis protocol for GET, SET and DEL over a
+// single connection, which is redialed after any error, rather than pulling
+// in a client library. The zero value isn't usable: Addr must be set.
+//
+// NOTE(aroman) A Store only shares *completed* tasks. Waiting on an instance
+// that didn't start the task finds nothing until it's done, so clients should
+// keep polling the instance they started it on (or any of them, with a short
+// wait) until then. Pub/sub could fix that, but it's more than a Store.
+type RedisStore struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Prefix is prepended to task ids to make the Redis keys, e.g.
+	// "hashex:task:", so that the tasks can share a Redis with other data.
+	Prefix string
+	// Timeout limits how long each command (including dialing) can take. If
+	// zero, DefaultRedisTimeout is used.
+	Timeout time.Duration
+
+	mutex sync.Mutex
+	conn  net.Conn
+	r     *bufio.Reader
+}
+
+// DefaultRedisTimeout is how long RedisStore commands can take unless
+// RedisStore.Timeout says otherwise.
+const DefaultRedisTimeout = 5 * time.Second
+
+func (s *RedisStore) Save(rec TaskRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.do("SET", s.Prefix+string(rec.Id), string(data))
+	return err
+}
+
+func (s *RedisStore) Load(id Id) (TaskRecord, error) {
+	var rec TaskRecord
+	reply, err := s.do("GET", s.Prefix+string(id))
+	if err != nil {
+		return rec, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return rec, ErrNoSuchTask // a nil reply: there's no such key
+	}
+	err = json.Unmarshal([]byte(data), &rec)
+	return rec, err
+}
+
+func (s *RedisStore) Delete(id Id) error {
+	_, err := s.do("DEL", s.Prefix+string(id))
+	return err
+}
+
+// redisError is an error reply from Redis. Unlike I/O errors, it leaves the
+// connection in a usable state.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do sends the command and returns its reply: a string for simple and bulk
+// strings, an int64 for integers and nil for a nil reply. The connection is
+// dropped after any error other than an error reply, since there's no telling
+// what state it's in.
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultRedisTimeout
+	}
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.Addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		s.conn, s.r = conn, bufio.NewReader(conn)
+	}
+	reply, err := s.roundTrip(timeout, args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+	return reply, err
+}
+
+// roundTrip must be called with the mutex held and a connection open.
+func (s *RedisStore) roundTrip(timeout time.Duration, args []string) (interface{}, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(s.r)
+}
+
+// readRedisReply reads a single non-array reply in the Redis protocol (RESP).
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	switch kind, val := line[0], line[1:]; kind {
+	case '+':
+		return val, nil
+	case '-':
+		return nil, redisError(val)
+	case ':':
+		return strconv.ParseInt(val, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		} else if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2) // and the trailing \r\n
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,192 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis serves just enough of the Redis protocol for RedisStore, standing
+// in for a real Redis server. It returns the address it listens on.
+func fakeRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mutex sync.Mutex
+	data := map[string]string{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readFakeRedisCommand(r)
+					if err != nil {
+						return
+					}
+					mutex.Lock()
+					switch strings.ToUpper(args[0]) {
+					case "GET":
+						if val, ok := data[args[1]]; ok {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(val), val)
+						} else {
+							io.WriteString(conn, "$-1\r\n")
+						}
+					case "SET":
+						data[args[1]] = args[2]
+						io.WriteString(conn, "+OK\r\n")
+					case "DEL":
+						_, ok := data[args[1]]
+						delete(data, args[1])
+						if ok {
+							io.WriteString(conn, ":1\r\n")
+						} else {
+							io.WriteString(conn, ":0\r\n")
+						}
+					default:
+						fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// readFakeRedisCommand reads a command, which clients send as an array of
+// bulk strings.
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func(prefix string) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if !strings.HasPrefix(line, prefix) {
+			return 0, fmt.Errorf("expected %q, got %q", prefix, line)
+		}
+		return strconv.Atoi(strings.TrimSpace(line[1:]))
+	}
+	n, err := readLine("*")
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLine("$")
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	testRedisStore := func(t *testing.T, addr string) {
+		ctx := context.Background()
+		// Don't trip over whatever's left from previous runs on a real Redis.
+		prefix := fmt.Sprintf("hashex-test:%s:", RandomId())
+		t.Run("saves, loads and deletes records", func(t *testing.T) {
+			store := &RedisStore{Addr: addr, Prefix: prefix}
+			records := []TaskRecord{
+				{Id: "1", Type: "hash", Status: Done, Result: "abc"},
+				{Id: "2", Type: "hash", Status: Failed, Err: "oops\r\n$-1\r\n"},
+			}
+			for _, rec := range records {
+				if err := store.Save(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, rec := range records {
+				loaded, err := store.Load(rec.Id)
+				if err != nil || !reflect.DeepEqual(loaded, rec) {
+					t.Errorf("Wrong record for %s: %+v %v", rec.Id, loaded, err)
+				}
+			}
+			for _, id := range []Id{"1", "2", "1"} {
+				if err := store.Delete(id); err != nil {
+					t.Errorf("Cannot delete %s: %v", id, err)
+				}
+			}
+			if _, err := store.Load("1"); err != ErrNoSuchTask {
+				t.Errorf("Deleted record is still there: %v", err)
+			}
+		})
+		t.Run("shares tasks between Managers", func(t *testing.T) {
+			// Separate stores too, like separate instances would have.
+			a := Manager{Store: &RedisStore{Addr: addr, Prefix: prefix}}
+			b := Manager{Store: &RedisStore{Addr: addr, Prefix: prefix}}
+			done, _ := a.Start(new(trackRunsTask))
+			failed, _ := a.Start(failTask("oops"))
+			a.Wait(ctx, done)
+			a.Wait(ctx, failed)
+
+			if res, err := b.Wait(ctx, done); err != nil || res != "done" {
+				t.Errorf("Wrong output for %s: res=%#v err=%v", done, res, err)
+			}
+			if res, err := b.Wait(ctx, failed); err == nil || err.Error() != "oops" {
+				t.Errorf("Wrong output for %s: res=%#v err=%v", failed, res, err)
+			}
+			if err := b.Delete(done); err != nil {
+				t.Fatal(err)
+			}
+			// a still has it in memory, but nobody else will find it.
+			c := Manager{Store: &RedisStore{Addr: addr, Prefix: prefix}}
+			if _, err := c.Wait(ctx, done); err != ErrNoSuchTask {
+				t.Errorf("Deleted task is still stored: %v", err)
+			}
+			b.Delete(failed)
+		})
+	}
+
+	t.Run("fake", func(t *testing.T) {
+		testRedisStore(t, fakeRedis(t))
+	})
+	t.Run("real", func(t *testing.T) {
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			t.Skip("Set REDIS_ADDR to test against a real Redis server")
+		}
+		testRedisStore(t, addr)
+	})
+	t.Run("reports errors", func(t *testing.T) {
+		store := &RedisStore{Addr: fakeRedis(t)}
+		if _, err := store.do("FLUSHALL"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+			t.Errorf("Wrong error: %v", err)
+		}
+		// The connection is still good after an error reply.
+		if err := store.Save(TaskRecord{Id: "1", Status: Done}); err != nil {
+			t.Errorf("Cannot save after an error reply: %v", err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+		store = &RedisStore{Addr: addr}
+		if _, err := store.Load("1"); err == nil || err == ErrNoSuchTask {
+			t.Errorf("Expected a connection error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package task
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInterrupted is the error recorded for tasks that were still pending or
+// running when they were snapshotted and are later restored: there's no way
+// to resume them.
+var ErrInterrupted = errors.New("task was interrupted before completing")
+
+// TaskRecord is a plain-data description of a task and its outcome, suitable
+// for persisting so that a restarted Manager can keep serving results.
+type TaskRecord struct {
+	Id     Id
+	Type   string // see TypeOf
+	Status TaskStatus
+	Result interface{} // Only set for Done tasks.
+	Err    string      // Only set for Failed tasks.
+	// Finished is when the task completed, which is what its TTL counts
+	// from. It's zero for tasks that hadn't completed yet.
+	Finished time.Time
+}
+
+// Snapshot captures the state of all tasks. It's safe to call at any time,
+// but it's most useful after Shutdown, when nothing is changing anymore.
+//
+// Results are included as-is, so persisting them requires that they are
+// serializable by whatever storage is used.
+func (tm *Manager) Snapshot() []TaskRecord {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.sweep()
+	records := make([]TaskRecord, 0, len(tm.tasks))
+	now := time_Now()
+	for id, ti := range tm.tasks {
+		if tm.expired(ti, now) {
+			continue
+		}
+		rec := TaskRecord{Id: id, Type: ti.typ, Status: ti.status}
+		// The outputs are only safe to read once the task has completed,
+		// which is exactly when they are meaningful.
+		switch ti.status {
+		case Done:
+			// Decompressing can't really fail for data we compressed ourselves.
+			rec.Result, _ = decompress(ti.result)
+			rec.Finished = ti.finished
+		case Failed:
+			rec.Err = ti.err.Error()
+			rec.Finished = ti.finished
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Restore adds previously snapshotted tasks to the manager as completed
+// tasks, so Wait returns their outputs immediately. Tasks that hadn't
+// completed when they were snapshotted are restored as failed with
+// ErrInterrupted. Records whose id is already in use are skipped.
+//
+// Restored tasks keep the time they finished, so restarting doesn't extend
+// their TTL: ones that have expired in the meantime are dropped (and deleted
+// from the Store) as soon as they're looked up or swept. Only tasks without a
+// Finished time, such as the interrupted ones, count as finishing when they're
+// restored.
+func (tm *Manager) Restore(records []TaskRecord) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.tasks == nil {
+		tm.tasks = map[Id]*taskOutput{}
+	}
+	for _, rec := range records {
+		if tm.lookup(rec.Id) != nil {
+			continue
+		}
+		tm.tasks[rec.Id] = restored(rec)
+	}
+}
+
+// restored creates a completed task from the record.
+func restored(rec TaskRecord) *taskOutput {
+	ti := &taskOutput{
+		typ:      rec.Type,
+		status:   rec.Status,
+		finished: rec.Finished,
+		done:     make(chan struct{}),
+	}
+	switch rec.Status {
+	case Done:
+		ti.result = rec.Result
+	case Failed:
+		ti.err = errors.New(rec.Err)
+	default:
+		ti.status, ti.err = Failed, ErrInterrupted
+	}
+	if ti.finished.IsZero() {
+		ti.finished = time_Now()
+	}
+	close(ti.done)
+	return ti
+}
@@ -0,0 +1,94 @@
+package task
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	tm := Manager{IdGenerator: SequentialIds()}
+	// Wait for the running task to finish below, since other tests fake
+	// time_Now.
+	defer tm.Shutdown(context.Background())
+	changes := recordStateChanges(&tm)
+	var done trackRunsTask
+	running := syncTask(make(chan string))
+
+	tm.Start(&done)
+	assertRecvWithin(t, changes, "1: pending -> running", time.Second)
+	assertRecvWithin(t, changes, "1: running -> done", time.Second)
+	tm.Start(failTask("oops"))
+	assertRecvWithin(t, changes, "2: pending -> running", time.Second)
+	assertRecvWithin(t, changes, "2: running -> failed", time.Second)
+	tm.Start(running)
+	assertRecvWithin(t, running, "started!", time.Second)
+	defer func() { running <- "finish" }()
+
+	records := tm.Snapshot()
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	expected := []TaskRecord{
+		{Id: "1", Type: "*task.trackRunsTask", Status: Done, Result: "done"},
+		{Id: "2", Type: "task.failTask", Status: Failed, Err: "oops"},
+		{Id: "3", Type: "task.syncTask", Status: Running},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Wrong records: %+v", records)
+	}
+	for i := range expected {
+		// Only completed tasks have finished, and when exactly doesn't matter.
+		if finished := records[i].Finished; finished.IsZero() != (records[i].Status == Running) {
+			t.Errorf("Wrong finish time for record %d: %v", i, finished)
+		}
+		have := records[i]
+		have.Finished = time.Time{}
+		if have != expected[i] {
+			t.Errorf("Wrong record %d:\nHave: %+v\nWant: %+v", i, records[i], expected[i])
+		}
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		restored := Manager{IdGenerator: SequentialIds()}
+		defer restored.Shutdown(context.Background()) // the new tasks below
+		restored.Restore(records)
+		// Don't clobber existing tasks.
+		restored.Restore([]TaskRecord{{Id: "1", Status: Done, Result: "other"}})
+
+		ctx := context.Background()
+		if res, err := restored.Wait(ctx, "1"); err != nil || res != "done" {
+			t.Errorf("Wrong output for 1: res=%#v err=%v", res, err)
+		}
+		if res, err := restored.Wait(ctx, "2"); err == nil || err.Error() != "oops" {
+			t.Errorf("Wrong output for 2: res=%#v err=%v", res, err)
+		}
+		if res, err := restored.Wait(ctx, "3"); err != ErrInterrupted {
+			t.Errorf("Wrong output for 3: res=%#v err=%v", res, err)
+		}
+
+		// New tasks don't collide with the restored ones.
+		restored.Restore([]TaskRecord{{Id: "5", Status: Done, Result: "five"}})
+		for i := 0; i < 3; i++ {
+			if id, _ := restored.Start(&done); id == "5" {
+				t.Errorf("New task clobbered a restored one")
+			}
+		}
+		if res, err := restored.Wait(ctx, "5"); err != nil || res != "five" {
+			t.Errorf("Wrong output for 5: res=%#v err=%v", res, err)
+		}
+	})
+	t.Run("Restore keeps the finish time", func(t *testing.T) {
+		restored := Manager{TTL: time.Minute}
+		restored.Restore([]TaskRecord{
+			{Id: "old", Status: Done, Result: "old", Finished: time.Now().Add(-time.Hour)},
+			{Id: "new", Status: Done, Result: "new", Finished: time.Now()},
+		})
+		ctx := context.Background()
+		if _, err := restored.Wait(ctx, "old"); err != ErrNoSuchTask {
+			t.Errorf("Restoring extended the TTL: %v", err)
+		}
+		if res, err := restored.Wait(ctx, "new"); err != nil || res != "new" {
+			t.Errorf("Wrong output for new: res=%#v err=%v", res, err)
+		}
+	})
+}
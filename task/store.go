@@ -0,0 +1,136 @@
+package task
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Store persists the records of completed tasks, see Manager.Store. It must be
+// safe for concurrent use.
+type Store interface {
+	// Save records a completed task, replacing any previous record of it.
+	Save(rec TaskRecord) error
+	// Load returns the record of the task, or ErrNoSuchTask.
+	Load(id Id) (TaskRecord, error)
+	// Delete forgets the task. It's not an error if there's no such task.
+	Delete(id Id) error
+}
+
+// save persists the outputs of the completed task, if there's a Store. Errors
+// are logged rather than failing the task: it still completed, it's just not
+// durable.
+func (tm *Manager) save(id Id, ti *taskOutput, status TaskStatus, result interface{}, err error) {
+	if tm.Store == nil {
+		return
+	}
+	// The task is about to finish, see setStatus. This is a hair earlier,
+	// which only makes the stored copy expire a hair sooner.
+	rec := TaskRecord{Id: id, Type: ti.typ, Status: status, Result: result, Finished: time_Now()}
+	if err != nil {
+		rec.Result, rec.Err = nil, err.Error()
+	}
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.tasks[id] != ti {
+		return // deleted while it was running, so don't resurrect it
+	}
+	if err := tm.Store.Save(rec); err != nil {
+		log.Printf("ERROR: Cannot save task %s: %v", id, err)
+	}
+}
+
+// load looks for the task in the Store and, if it's there, adds it to the
+// in-memory tasks like Restore does. It must be called with the mutex held.
+//
+// NOTE(aroman) This (and save and forget) do I/O with the mutex held, which is
+// fine for DirStore but would hurt with a slow remote Store.
+func (tm *Manager) load(id Id) *taskOutput {
+	rec, err := tm.Store.Load(id)
+	if err != nil {
+		if err != ErrNoSuchTask {
+			log.Printf("ERROR: Cannot load task %s: %v", id, err)
+		}
+		return nil
+	}
+	if tm.tasks == nil {
+		tm.tasks = map[Id]*taskOutput{}
+	}
+	ti := restored(rec)
+	tm.tasks[id] = ti
+	return ti
+}
+
+// forget removes the task (and its StartOnce key) from memory and from the
+// Store, if there is one. It must be called with the mutex held.
+func (tm *Manager) forget(id Id) {
+	if ti := tm.tasks[id]; ti != nil && ti.key != "" {
+		delete(tm.keys, ti.key)
+	}
+	delete(tm.tasks, id)
+	if tm.Store != nil {
+		if err := tm.Store.Delete(id); err != nil {
+			log.Printf("ERROR: Cannot delete task %s: %v", id, err)
+		}
+	}
+}
+
+// DirStore is a Store that keeps each task in its own JSON file in the named
+// directory, which must already exist.
+//
+// Results are stored as JSON, so they come back as their generic JSON
+// equivalents: a struct comes back as a map[string]interface{}, for example.
+// That's fine for results that are only ever served as JSON anyway.
+type DirStore string
+
+// path returns the file for the task. Ids are hex-encoded so that whatever's
+// in them can't escape the directory.
+func (d DirStore) path(id Id) string {
+	return filepath.Join(string(d), hex.EncodeToString([]byte(id))+".json")
+}
+
+func (d DirStore) Save(rec TaskRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// Write it to a temp file first, so that a crash never leaves a partial
+	// record behind.
+	f, err := os.CreateTemp(string(d), "saving-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.path(rec.Id))
+}
+
+func (d DirStore) Load(id Id) (TaskRecord, error) {
+	var rec TaskRecord
+	data, err := os.ReadFile(d.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return rec, ErrNoSuchTask
+	} else if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+func (d DirStore) Delete(id Id) error {
+	err := os.Remove(d.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
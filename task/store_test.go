@@ -0,0 +1,183 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store, standing in for a real one that would
+// survive a restart.
+type memStore struct {
+	mutex   sync.Mutex
+	records map[Id]TaskRecord
+}
+
+func (m *memStore) Save(rec TaskRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.records == nil {
+		m.records = map[Id]TaskRecord{}
+	}
+	m.records[rec.Id] = rec
+	return nil
+}
+func (m *memStore) Load(id Id) (TaskRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	rec, ok := m.records[id]
+	if !ok {
+		return rec, ErrNoSuchTask
+	}
+	return rec, nil
+}
+func (m *memStore) Delete(id Id) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.records, id)
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	t.Run("results survive a restart", func(t *testing.T) {
+		store := &memStore{}
+		before := Manager{Store: store, CompressAbove: 1}
+		done, _ := before.Start(new(trackRunsTask))
+		failed, _ := before.Start(failTask("oops"))
+		before.Shutdown(ctx)
+
+		after := Manager{Store: store}
+		if res, err := after.Wait(ctx, done); err != nil || res != "done" {
+			t.Errorf("Wrong output for %s: res=%#v err=%v", done, res, err)
+		}
+		if res, err := after.Wait(ctx, failed); err == nil || err.Error() != "oops" {
+			t.Errorf("Wrong output for %s: res=%#v err=%v", failed, res, err)
+		}
+		if status, err := after.Status("nope"); err != ErrNoSuchTask {
+			t.Errorf("Found a task that doesn't exist: %v %v", status, err)
+		}
+	})
+	t.Run("deleting forgets the stored task", func(t *testing.T) {
+		store := &memStore{}
+		tm := Manager{Store: store}
+		id, _ := tm.Start(new(trackRunsTask))
+		tm.Wait(ctx, id)
+		if err := tm.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Load(id); err != ErrNoSuchTask {
+			t.Errorf("Task is still stored: %v", err)
+		}
+	})
+	t.Run("deleted running tasks aren't saved", func(t *testing.T) {
+		store := &memStore{}
+		tm := Manager{Store: store}
+		block := make(blockTask)
+		id, _ := tm.Start(block)
+		tm.Delete(id)
+		close(block)
+		tm.Shutdown(ctx)
+		if _, err := store.Load(id); err != ErrNoSuchTask {
+			t.Errorf("Deleted task was saved: %v", err)
+		}
+	})
+	t.Run("restarting doesn't extend the TTL", func(t *testing.T) {
+		defer func() { time_Now = time.Now }()
+		now := time.Now()
+		time_Now = func() time.Time { return now }
+
+		store := &memStore{}
+		before := Manager{Store: store, TTL: time.Minute}
+		id, _ := before.Start(new(trackRunsTask))
+		before.Wait(ctx, id)
+		before.Shutdown(ctx)
+
+		now = now.Add(30 * time.Second)
+		after := Manager{Store: store, TTL: time.Minute}
+		defer after.Shutdown(ctx) // before restoring time_Now
+		if res, err := after.Wait(ctx, id); err != nil || res != "done" {
+			t.Errorf("Expired too early: res=%#v err=%v", res, err)
+		}
+		now = now.Add(30 * time.Second)
+		if _, err := after.Wait(ctx, id); err != ErrNoSuchTask {
+			t.Errorf("Expected task to have expired: %v", err)
+		}
+		if _, err := store.Load(id); err != ErrNoSuchTask {
+			t.Errorf("Expired task is still stored: %v", err)
+		}
+	})
+	t.Run("sweeping deletes expired tasks from the store", func(t *testing.T) {
+		defer func() { time_Now = time.Now }()
+		now := time.Now()
+		time_Now = func() time.Time { return now }
+
+		store := &memStore{}
+		tm := Manager{Store: store, TTL: time.Minute, IdGenerator: SequentialIds()}
+		defer tm.Shutdown(ctx) // before restoring time_Now
+		for i := 0; i < 2; i++ {
+			id, _ := tm.Start(new(trackRunsTask))
+			tm.Wait(ctx, id)
+		}
+
+		now = now.Add(time.Hour)
+		id, _ := tm.Start(new(trackRunsTask))
+		tm.Wait(ctx, id)
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		if len(store.records) != 1 || store.records["3"].Id != "3" {
+			t.Errorf("Expired tasks weren't deleted: %v", store.records)
+		}
+	})
+	t.Run("skips ids that are already stored", func(t *testing.T) {
+		store := &memStore{}
+		first := Manager{Store: store, IdGenerator: SequentialIds()}
+		id, _ := first.Start(new(trackRunsTask))
+		first.Wait(ctx, id)
+
+		// Another Manager sharing the store doesn't know about "1" yet.
+		second := Manager{Store: store, IdGenerator: SequentialIds()}
+		id, _ = second.Start(failTask("oops"))
+		if id != "2" {
+			t.Errorf("Wrong id: %#q", id)
+		}
+		second.Wait(ctx, id)
+		if rec, err := store.Load("1"); err != nil || rec.Result != "done" {
+			t.Errorf("Stored task was clobbered: %#v %v", rec, err)
+		}
+	})
+}
+
+func TestDirStore(t *testing.T) {
+	store := DirStore(t.TempDir())
+	records := []TaskRecord{
+		{Id: "1", Type: "hash", Status: Done, Result: "abc", Finished: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Id: "../2", Type: "hash", Status: Failed, Err: "oops"},
+	}
+	for _, rec := range records {
+		if err := store.Save(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rec := range records {
+		loaded, err := store.Load(rec.Id)
+		if err != nil || !reflect.DeepEqual(loaded, rec) {
+			t.Errorf("Wrong record for %s: %+v %v", rec.Id, loaded, err)
+		}
+	}
+	if err := store.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load("1"); err != ErrNoSuchTask {
+		t.Errorf("Deleted record is still there: %v", err)
+	}
+	if err := store.Delete("1"); err != nil {
+		t.Errorf("Deleting a missing record failed: %v", err)
+	}
+	if _, err := DirStore("/does/not/exist").Load("1"); !errors.Is(err, ErrNoSuchTask) {
+		t.Errorf("Wrong error for a missing directory: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TypedInterface is a task whose result is always a T. It's like Interface,
+// but for use with a TypedManager.
+type TypedInterface[T any] interface {
+	Run() (T, error)
+}
+
+// TypedContextRunner is the TypedInterface equivalent of ContextRunner.
+type TypedContextRunner[T any] interface {
+	RunContext(ctx context.Context) (T, error)
+}
+
+// TypedManager is a Manager for tasks that all have the same type of result,
+// so that callers don't have to deal with interface{} results themselves. Use
+// a plain Manager for tasks with different types of results.
+//
+// The typed tasks are wrapped in order to run them on the underlying Manager,
+// so Info and List report the wrappers rather than the original tasks. The
+// wrappers keep the original task's Type for the run statistics, but any other
+// optional interfaces that the task implements are hidden.
+type TypedManager[T any] struct {
+	Manager
+}
+
+// Start is like Manager.Start, but for a typed task.
+func (tm *TypedManager[T]) Start(task TypedInterface[T]) (Id, error) {
+	return tm.Manager.Start(untyped(task))
+}
+
+// StartWithTimeout is like Manager.StartWithTimeout, but for a typed task.
+func (tm *TypedManager[T]) StartWithTimeout(task TypedInterface[T], timeout time.Duration) (Id, error) {
+	return tm.Manager.StartWithTimeout(untyped(task), timeout)
+}
+
+// StartWithRetry is like Manager.StartWithRetry, but for a typed task.
+func (tm *TypedManager[T]) StartWithRetry(task TypedInterface[T], retry RetryPolicy) (Id, error) {
+	return tm.Manager.StartWithRetry(untyped(task), retry)
+}
+
+// Wait is like Manager.Wait, but returns the result as a T. A nil result is
+// returned as the zero T. It's an error if the result isn't a T at all, which
+// can only happen if something else started the task via the embedded Manager
+// or if the result came out of the Store in some other form (e.g. a struct
+// that was decoded from JSON as a map).
+func (tm *TypedManager[T]) Wait(ctx context.Context, id Id) (T, error) {
+	var zero T
+	res, err := tm.Manager.Wait(ctx, id)
+	if err != nil || res == nil {
+		return zero, err
+	}
+	typed, ok := res.(T)
+	if !ok {
+		return zero, fmt.Errorf("task %s: result is a %T, not a %T", id, res, zero)
+	}
+	return typed, nil
+}
+
+// untyped wraps the typed task so that the Manager can run it.
+func untyped[T any](task TypedInterface[T]) Interface {
+	if cr, ok := task.(TypedContextRunner[T]); ok {
+		return untypedContextTask[T]{untypedTask[T]{task}, cr}
+	}
+	return untypedTask[T]{task}
+}
+
+type untypedTask[T any] struct{ task TypedInterface[T] }
+
+func (t untypedTask[T]) Run() (interface{}, error) {
+	res, err := t.task.Run()
+	return res, err
+}
+
+func (t untypedTask[T]) Type() string {
+	if typer, ok := t.task.(Typer); ok {
+		return typer.Type()
+	}
+	return fmt.Sprintf("%T", t.task)
+}
+
+// untypedContextTask is separate from untypedTask since the Manager treats
+// tasks differently depending on whether they implement ContextRunner.
+type untypedContextTask[T any] struct {
+	untypedTask[T]
+	cr TypedContextRunner[T]
+}
+
+func (t untypedContextTask[T]) RunContext(ctx context.Context) (interface{}, error) {
+	res, err := t.cr.RunContext(ctx)
+	return res, err
+}
@@ -0,0 +1,59 @@
+package task
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type upperTask string
+type slowUpperTask string
+
+func (u upperTask) Run() (string, error) { return strings.ToUpper(string(u)), nil }
+func (u upperTask) Type() string         { return "upper" }
+
+func (s slowUpperTask) Run() (string, error) { panic("should use RunContext") }
+func (s slowUpperTask) RunContext(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestTypedManager(t *testing.T) {
+	ctx := context.Background()
+	t.Run("returns typed results", func(t *testing.T) {
+		var tm TypedManager[string]
+		id, err := tm.Start(upperTask("monkey"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res string // not interface{}
+		res, err = tm.Wait(ctx, id)
+		if err != nil || res != "MONKEY" {
+			t.Errorf("Wrong output: res=%#v err=%v", res, err)
+		}
+		if stats := tm.RunStats(); stats["upper"].Count != 1 {
+			t.Errorf("Didn't keep the task's type for the stats: %v", stats)
+		}
+	})
+	t.Run("runs context-aware tasks with their context", func(t *testing.T) {
+		var tm TypedManager[string]
+		id, _ := tm.StartWithTimeout(slowUpperTask("monkey"), 10*time.Millisecond)
+		if res, err := tm.Wait(ctx, id); err != context.DeadlineExceeded || res != "" {
+			t.Errorf("Wrong output: res=%#v err=%v", res, err)
+		}
+	})
+	t.Run("reports results of the wrong type", func(t *testing.T) {
+		var tm TypedManager[int]
+		id, _ := tm.Manager.Start(new(trackRunsTask)) // returns "done"
+		if res, err := tm.Wait(ctx, id); err == nil || res != 0 {
+			t.Errorf("Wrong output: res=%#v err=%v", res, err)
+		}
+	})
+	t.Run("reports missing tasks", func(t *testing.T) {
+		var tm TypedManager[string]
+		if res, err := tm.Wait(ctx, "nope"); err != ErrNoSuchTask || res != "" {
+			t.Errorf("Wrong output: res=%#v err=%v", res, err)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PasswordList is a set of known-weak (e.g. breached) passwords that can be
+// reloaded while in use. The zero value is an empty list.
+type PasswordList struct {
+	mutex     sync.RWMutex
+	passwords map[string]struct{}
+}
+
+// Load replaces the list with the contents of the file, which has one
+// password per line. On error, the existing list is left unchanged.
+func (p *PasswordList) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	passwords := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Don't trim spaces, they're legit password characters. Windows
+		// line endings are not.
+		if line := strings.TrimSuffix(scanner.Text(), "\r"); line != "" {
+			passwords[line] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	p.passwords = passwords
+	p.mutex.Unlock()
+	return nil
+}
+
+// Len returns the number of passwords in the list.
+func (p *PasswordList) Len() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.passwords)
+}
+
+// Contains returns whether the password is in the list.
+func (p *PasswordList) Contains(password string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	_, found := p.passwords[password]
+	return found
+}
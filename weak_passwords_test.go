@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weak.txt")
+	write := func(contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var list PasswordList
+	if list.Contains("password") {
+		t.Errorf("Empty list contains something")
+	}
+
+	write("password\r\n123456\n\n  spaces  \n")
+	if err := list.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for pw, expected := range map[string]bool{
+		"password":   true,
+		"123456":     true,
+		"  spaces  ": true,
+		"spaces":     false,
+		"":           false,
+		"hunter2":    false,
+	} {
+		if list.Contains(pw) != expected {
+			t.Errorf("Contains(%q) should be %v", pw, expected)
+		}
+	}
+	if n := list.Len(); n != 3 {
+		t.Errorf("Wrong length: %d", n)
+	}
+
+	t.Run("reloads", func(t *testing.T) {
+		write("hunter2\n")
+		if err := list.Load(path); err != nil {
+			t.Fatal(err)
+		}
+		if list.Contains("password") || !list.Contains("hunter2") {
+			t.Errorf("Didn't reload the list")
+		}
+	})
+	t.Run("keeps the old list on error", func(t *testing.T) {
+		if err := list.Load(path + ".missing"); err == nil {
+			t.Fatal("Expected an error for a missing file")
+		}
+		if !list.Contains("hunter2") {
+			t.Errorf("Lost the old list")
+		}
+	})
+}